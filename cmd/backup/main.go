@@ -3,12 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/imtaco/vwmgr/pkg/common"
+	"github.com/imtaco/vwmgr/pkg/logging"
+	"github.com/imtaco/vwmgr/pkg/model"
 	"github.com/imtaco/vwmgr/pkg/pkcs"
 	"github.com/imtaco/vwmgr/pkg/utils"
 	"github.com/jessevdk/go-flags"
@@ -28,14 +30,37 @@ type appArgs struct {
 type modifyFunc func(value interface{}) interface{}
 
 func main() {
+	logger := logging.Setup()
+
 	args := appArgs{}
 	if _, err := flags.Parse(&args); err != nil {
-		log.Fatal(err)
+		logging.Fatal("fail to parse args", "error", err)
 	}
 
 	restyClient := resty.New()
 
-	userMasterKey := pkcs.DeriveMasterKey(args.SaUserEmail, args.SaPassword)
+	dsn, err := utils.PGURLtoGormDSN(args.DatabaseURL)
+	if err != nil {
+		logging.Fatal("fail to convert pg URL to dsn", "error", err)
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		TranslateError: true,
+		Logger:         logging.GormLogger(logger),
+	})
+	if err != nil {
+		logging.Fatal("fail to open DB", "error", err)
+	}
+
+	saUser := model.User{}
+	if err := db.Where("email = ?", args.SaUserEmail).First(&saUser).Error; err != nil {
+		logging.Fatal("fail to get SA user", "error", err)
+	}
+
+	userMasterKey, err := pkcs.DeriveMasterKey(args.SaUserEmail, args.SaPassword, common.UserKdfParams(&saUser))
+	if err != nil {
+		logging.Fatal("fail to derive master key", "error", err)
+	}
 	passwordHash := pkcs.DerivePasswordHash(userMasterKey, args.SaPassword)
 
 	resp, err := restyClient.R().
@@ -52,10 +77,10 @@ func main() {
 		}).
 		Post(fmt.Sprintf("%s/identity/connect/token", args.BaseURL))
 	if err != nil {
-		log.Fatalf("fail to getting token: %v", err)
+		logging.Fatal("fail to getting token", "error", err)
 	}
 	if !resp.IsSuccess() {
-		log.Fatalf("fail to get token, status: %d, msg: %s", resp.StatusCode(), string(resp.Body()))
+		logging.Fatal("fail to get token", "status", resp.StatusCode(), "msg", string(resp.Body()))
 	}
 
 	type tokenResponse struct {
@@ -64,24 +89,14 @@ func main() {
 
 	var token tokenResponse
 	if err := json.Unmarshal(resp.Body(), &token); err != nil {
-		log.Fatalf("failed to parse token response: %v", err)
+		logging.Fatal("failed to parse token response", "error", err)
 	}
 
-	log.Println("✅ access Token received")
-
-	dsn, err := utils.PGURLtoGormDSN(args.DatabaseURL)
-	if err != nil {
-		log.Fatalf("fail to convert pg URL to dsn %v", err)
-	}
-
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
-	if err != nil {
-		log.Fatal("fail to open DB", err)
-	}
+	slog.Info("access token received")
 
 	orgSymKeys, err := common.GetOrgSymKeys(db, args.SaUserEmail, args.SaPassword)
 	if err != nil {
-		log.Fatalf("fail to get orgSymKey %v", err)
+		logging.Fatal("fail to get orgSymKey", "error", err)
 	}
 
 	for orgUUID, orgSymKey := range orgSymKeys {
@@ -94,16 +109,16 @@ func main() {
 			Get(fmt.Sprintf("%s//api/organizations/%s/export", args.BaseURL, orgUUID))
 
 		if err != nil {
-			log.Fatalf("fail to fetch data: %v", err)
+			logging.Fatal("fail to fetch data", "org_uuid", orgUUID, "error", err)
 		}
 		if !resp.IsSuccess() {
-			log.Fatalf("fail to fetch data, status: %d, msg: %s", apiResp.StatusCode(), string(apiResp.Body()))
+			logging.Fatal("fail to fetch data", "org_uuid", orgUUID, "status", apiResp.StatusCode(), "msg", string(apiResp.Body()))
 		}
-		log.Printf("✅ data received: %s", orgUUID)
+		slog.Info("data received", "org_uuid", orgUUID)
 
 		var results interface{}
 		if err := json.Unmarshal(apiResp.Body(), &results); err != nil {
-			log.Fatal(err)
+			logging.Fatal("fail to parse data", "org_uuid", orgUUID, "error", err)
 		}
 
 		mod := func(value interface{}) interface{} {
@@ -125,10 +140,10 @@ func main() {
 
 		bs, err := json.Marshal(results)
 		if err != nil {
-			log.Fatal(err)
+			logging.Fatal("fail to marshal data", "org_uuid", orgUUID, "error", err)
 		}
 		if err := os.WriteFile(outputFile, bs, 0644); err != nil {
-			log.Fatalf("fail to write file %s, err: %v", outputFile, err)
+			logging.Fatal("fail to write file", "file", outputFile, "error", err)
 		}
 	}
 }
@@ -1,10 +1,16 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/imtaco/vwmgr/pkg/common"
+	"github.com/imtaco/vwmgr/pkg/hibp"
+	"github.com/imtaco/vwmgr/pkg/logging"
+	"github.com/imtaco/vwmgr/pkg/mailer"
 	"github.com/imtaco/vwmgr/pkg/mgr"
 	"github.com/imtaco/vwmgr/pkg/utils"
 	"github.com/jessevdk/go-flags"
@@ -14,53 +20,128 @@ import (
 )
 
 type appArgs struct {
-	DatabaseURL       string `long:"database_url" env:"DATABASE_URL"`
-	BindAddr          string `long:"bind_addr" env:"BIND_ADDR" default:":9090"`
-	APIKey            string `long:"api_key" env:"API_KEY"`
-	SaUserEmail       string `long:"sa_user_email" env:"SA_USER_EMAIL"`
-	SaPassword        string `long:"sa_user_password" env:"SA_USER_PASSWORD"`
-	MigrateScriptPath string `long:"migrate_script_path" env:"MIGRATE_SCRIPT_PATH" default:"./migration"`
+	DatabaseURL        string `long:"database_url" env:"DATABASE_URL"`
+	BindAddr           string `long:"bind_addr" env:"BIND_ADDR" default:":9090"`
+	APIKey             string `long:"api_key" env:"API_KEY"`
+	SaUserEmail        string `long:"sa_user_email" env:"SA_USER_EMAIL"`
+	SaPassword         string `long:"sa_user_password" env:"SA_USER_PASSWORD"`
+	MigrateScriptPath  string `long:"migrate_script_path" env:"MIGRATE_SCRIPT_PATH" default:"./migration"`
+	SMTPAddr           string `long:"smtp_addr" env:"SMTP_ADDR" description:"host:port, generated passwords are not supported if empty"`
+	SMTPFrom           string `long:"smtp_from" env:"SMTP_FROM"`
+	SMTPUsername       string `long:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword       string `long:"smtp_password" env:"SMTP_PASSWORD"`
+	PwnedPasswordsPath string `long:"pwned_passwords_path" env:"PWNED_PASSWORDS_PATH" description:"range directory or sorted SHA-1 file of Pwned Passwords"`
+}
+
+type bulkCreateArgs struct {
+	File   string `long:"file" required:"true" description:"CSV or JSON file of users"`
+	Format string `long:"format" choice:"csv" choice:"json" description:"format of file, by extension if not set"`
+	Atomic bool   `long:"atomic" description:"create none of users if any row fails"`
 }
 
 func main() {
+	logger := logging.Setup()
+
 	args := appArgs{}
-	if _, err := flags.Parse(&args); err != nil {
-		log.Fatal("err:", err)
+	bulkArgs := bulkCreateArgs{}
+	parser := flags.NewParser(&args, flags.Default)
+	parser.SubcommandsOptional = true
+	if _, err := parser.AddCommand(
+		"bulk_create",
+		"Create users from file",
+		"Create users from a CSV or JSON file, then print the result of each row.",
+		&bulkArgs,
+	); err != nil {
+		logging.Fatal("fail to add command", "error", err)
+	}
+	if _, err := parser.Parse(); err != nil {
+		logging.Fatal("fail to parse args", "error", err)
 	}
 
 	// TODO: args validation
 	dsn, err := utils.PGURLtoGormDSN(args.DatabaseURL)
 	if err != nil {
-		log.Fatalf("fail to convert pg URL to dsn %v", err)
+		logging.Fatal("fail to convert pg URL to dsn", "error", err)
 	}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		TranslateError: true,
+		Logger:         logging.GormLogger(logger),
+	})
 	if err != nil {
-		log.Fatalf("fail to open DB: %v", err)
+		logging.Fatal("fail to open DB", "error", err)
 	}
 
 	// migration
 	if err := goose.SetDialect(string(goose.DialectPostgres)); err != nil {
-		log.Fatalf("failed to set dialect: %v", err)
+		logging.Fatal("failed to set dialect", "error", err)
 	}
 	sqlDb, err := db.DB()
 	if err != nil {
-		log.Fatalf("an error occurred receiving the db instance: %v", err)
+		logging.Fatal("an error occurred receiving the db instance", "error", err)
 	}
 	if err := goose.Up(sqlDb, args.MigrateScriptPath); err != nil {
-		log.Fatalf("an error occurred during migration: %v", err)
+		logging.Fatal("an error occurred during migration", "error", err)
 	}
 
 	orgSymKeys, err := common.GetOrgSymKeys(db, args.SaUserEmail, args.SaPassword)
 	if err != nil {
-		log.Fatalf("fail to get orgSymKey %v", err)
+		logging.Fatal("fail to get orgSymKey", "error", err)
 	}
 
-	mgr := mgr.New(orgSymKeys, args.APIKey, db)
+	var sender mailer.Sender
+	if args.SMTPAddr != "" {
+		sender = mailer.NewSMTPSender(args.SMTPAddr, args.SMTPFrom, args.SMTPUsername, args.SMTPPassword)
+	}
 
-	// TODO: switch to prod
-	g := gin.Default()
+	var pwned *hibp.Store
+	if args.PwnedPasswordsPath != "" {
+		if pwned, err = hibp.Open(args.PwnedPasswordsPath); err != nil {
+			logging.Fatal("fail to open pwned passwords list", "error", err)
+		}
+	}
+
+	mgr := mgr.New(orgSymKeys, args.SaUserEmail, args.APIKey, db, sender, pwned)
+
+	if parser.Active != nil && parser.Active.Name == "bulk_create" {
+		os.Exit(bulkCreate(mgr, bulkArgs))
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	g := gin.New()
+	g.Use(logging.Middleware(logger), gin.Recovery())
 	mgr.Bind(g)
 
 	g.Run(args.BindAddr)
 }
+
+// bulkCreate returns the exit code, non-zero if any row fails
+func bulkCreate(m *mgr.VMManager, args bulkCreateArgs) int {
+	f, err := os.Open(args.File)
+	if err != nil {
+		logging.Fatal("fail to open file", "file", args.File, "error", err)
+	}
+	defer f.Close()
+
+	format := args.Format
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(args.File)), ".")
+	}
+
+	results, err := m.BulkCreateUsers(f, format, args.Atomic)
+	if err != nil {
+		logging.Fatal("fail to create users", "error", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	code := 0
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			logging.Fatal("fail to write result", "error", err)
+		}
+		if r.Error != "" {
+			code = 1
+		}
+	}
+	return code
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"bytes"
 	"io"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/imtaco/vwmgr/pkg/logging"
 	"github.com/jessevdk/go-flags"
 	"github.com/pkg/errors"
 )
@@ -28,20 +28,22 @@ type appArgs struct {
 }
 
 func main() {
+	logger := logging.Setup()
+
 	args := appArgs{}
 	if _, err := flags.Parse(&args); err != nil {
-		log.Fatal("err:", err)
+		logging.Fatal("fail to parse args", "error", err)
 	}
 
 	// TODO: basic args validation
 	remote, err := url.Parse(args.UpStreamURL)
 	if err != nil {
-		log.Fatalf("fail to parse upstream url %v", err)
+		logging.Fatal("fail to parse upstream url", "error", err)
 	}
 
-	// disalbe logs
-	gin.DefaultWriter = io.Discard
-	g := gin.Default()
+	gin.SetMode(gin.ReleaseMode)
+	g := gin.New()
+	g.Use(logging.Middleware(logger), gin.Recovery())
 
 	// for health check of LB or k8s
 	g.GET("/_healthz", func(c *gin.Context) {})
@@ -0,0 +1,36 @@
+-- +goose Up
+CREATE TABLE mgr_secret_tokens (
+    uuid CHAR(36) NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE TABLE mgr_secret_token_collections (
+    token_uuid CHAR(36) NOT NULL REFERENCES mgr_secret_tokens (uuid) ON DELETE CASCADE,
+    collection_uuid CHAR(36) NOT NULL REFERENCES collections (uuid) ON DELETE CASCADE,
+    PRIMARY KEY (token_uuid, collection_uuid)
+);
+
+-- no foreign keys, logs are kept after tokens or items are gone
+CREATE TABLE mgr_secret_access_logs (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    token_uuid CHAR(36) NOT NULL,
+    token_name TEXT NOT NULL,
+    client_ip TEXT NOT NULL,
+    collection TEXT NOT NULL,
+    item TEXT NOT NULL,
+    field TEXT NOT NULL,
+    cipher_uuid CHAR(36),
+    status INTEGER NOT NULL
+);
+
+CREATE INDEX mgr_secret_access_logs_created_at_idx ON mgr_secret_access_logs (created_at);
+
+-- +goose Down
+DROP TABLE mgr_secret_access_logs;
+DROP TABLE mgr_secret_token_collections;
+DROP TABLE mgr_secret_tokens;
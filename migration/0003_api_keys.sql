@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE mgr_api_keys (
+    uuid CHAR(36) NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    key_hash TEXT NOT NULL UNIQUE,
+    -- space separated, e.g. "users:create reports:read"
+    scopes TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE mgr_api_keys;
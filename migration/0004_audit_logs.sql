@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE mgr_audit_logs (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    -- name of the API key
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL,
+    -- JSON
+    detail TEXT NOT NULL
+);
+
+CREATE INDEX mgr_audit_logs_created_at_idx ON mgr_audit_logs (created_at);
+
+-- +goose Down
+DROP TABLE mgr_audit_logs;
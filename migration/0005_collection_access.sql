@@ -0,0 +1,93 @@
+-- +goose Up
+-- effective access of members, with collections granted implicitly by
+-- Vaultwarden: owners and admins, and access_all of memberships or groups
+-- get all collections of the org. Managers with access_all can manage them.
+CREATE VIEW users_collections_access AS
+    WITH access_details AS (
+        SELECT
+            uc.collection_uuid,
+            uc.user_uuid,
+            uc.manage,
+            uc.read_only,
+            uo.status AS user_org_status,
+            uo.atype AS user_org_type,
+            TRUE AS direct,
+            NULL::TEXT AS group_uuid,
+            FALSE AS by_role,
+            FALSE AS by_access_all
+        FROM
+            users_collections uc
+            INNER JOIN collections c ON uc.collection_uuid = c.uuid
+            INNER JOIN users_organizations uo ON uo.org_uuid = c.org_uuid AND uo.user_uuid = uc.user_uuid
+        UNION ALL
+        SELECT
+            cg.collections_uuid,
+            uo.user_uuid,
+            cg.manage,
+            cg.read_only,
+            uo.status,
+            uo.atype,
+            FALSE,
+            cg.groups_uuid::TEXT,
+            FALSE,
+            FALSE
+        FROM
+            collections_groups cg
+            INNER JOIN groups_users gu ON cg.groups_uuid = gu.groups_uuid
+            INNER JOIN users_organizations uo ON uo.uuid = gu.users_organizations_uuid
+        UNION ALL
+        SELECT
+            c.uuid,
+            uo.user_uuid,
+            uo.atype IN (0, 1, 3),
+            FALSE,
+            uo.status,
+            uo.atype,
+            FALSE,
+            g.uuid::TEXT,
+            FALSE,
+            FALSE
+        FROM
+            groups g
+            INNER JOIN groups_users gu ON gu.groups_uuid = g.uuid
+            INNER JOIN users_organizations uo ON uo.uuid = gu.users_organizations_uuid
+            INNER JOIN collections c ON c.org_uuid = g.organizations_uuid
+        WHERE
+            g.access_all = TRUE
+        UNION ALL
+        SELECT
+            c.uuid,
+            uo.user_uuid,
+            uo.atype IN (0, 1, 3),
+            FALSE,
+            uo.status,
+            uo.atype,
+            FALSE,
+            NULL::TEXT,
+            uo.atype IN (0, 1),
+            uo.access_all
+        FROM
+            users_organizations uo
+            INNER JOIN collections c ON c.org_uuid = uo.org_uuid
+        WHERE
+            uo.atype IN (0, 1) OR uo.access_all = TRUE
+    )
+    SELECT
+        collection_uuid,
+        user_uuid,
+        max(user_org_status) AS user_org_status,
+        max(user_org_type) AS user_org_type,
+        bool_or(manage) AS manage,
+        bool_and(read_only) AS read_only,
+        bool_or(direct) AS direct,
+        -- comma separated, NULL if not granted by any group
+        string_agg(DISTINCT group_uuid, ',' ORDER BY group_uuid) AS group_uuids,
+        bool_or(by_role) AS by_role,
+        bool_or(by_access_all) AS by_access_all
+    FROM
+        access_details
+    GROUP BY
+        1, 2;
+
+-- +goose Down
+DROP VIEW users_collections_access;
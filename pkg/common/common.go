@@ -28,10 +28,18 @@ func GetOrgSymKeys(
 		return nil, err
 	}
 
-	masterKey := pkcs.DeriveMasterKey(userEmail, userMasterPwd)
+	kdf := UserKdfParams(&user)
+	masterKey, err := pkcs.DeriveMasterKey(userEmail, userMasterPwd, kdf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fail to derive master key of %s with stored %s", userEmail, kdf)
+	}
 	symKey, err := pkcs.BWSymDecrypt(masterKey, user.Akey)
 	if err != nil {
-		return nil, errors.Wrap(err, "fail to decrypt user akey")
+		return nil, errors.Wrapf(
+			err,
+			"fail to decrypt user akey of %s with stored %s, check the password",
+			userEmail, kdf,
+		)
 	}
 
 	privateKey, err := pkcs.BWSymDecrypt(symKey, user.PrivateKey)
@@ -52,3 +60,33 @@ func GetOrgSymKeys(
 	}
 	return result, nil
 }
+
+// UserKdfParams returns the KDF settings stored in the users row
+func UserKdfParams(user *model.User) pkcs.KdfParams {
+	kdf := pkcs.KdfParams{
+		Type:       pkcs.KdfType(user.ClientKdfType),
+		Iterations: int(user.ClientKdfIter),
+	}
+	if user.ClientKdfMemory != nil {
+		kdf.Memory = int(*user.ClientKdfMemory)
+	}
+	if user.ClientKdfParallelism != nil {
+		kdf.Parallelism = int(*user.ClientKdfParallelism)
+	}
+	return kdf
+}
+
+// KdfColumns returns users columns to store the KDF settings
+func KdfColumns(kdf pkcs.KdfParams) map[string]interface{} {
+	cols := map[string]interface{}{
+		"client_kdf_type":        int32(kdf.Type),
+		"client_kdf_iter":        int32(kdf.Iterations),
+		"client_kdf_memory":      nil,
+		"client_kdf_parallelism": nil,
+	}
+	if kdf.Type == pkcs.KdfArgon2id {
+		cols["client_kdf_memory"] = int32(kdf.Memory)
+		cols["client_kdf_parallelism"] = int32(kdf.Parallelism)
+	}
+	return cols
+}
@@ -0,0 +1,262 @@
+package hibp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	hashLen   = 40
+	prefixLen = 5
+)
+
+// Store looks up passwords in offline Pwned Passwords SHA-1 lists, either
+// a k-anonymity range directory of files named by 5 hex prefix, with
+// lines of "SUFFIX:COUNT", or a single file of "HASH:COUNT" lines sorted
+// by hash. Range files are streamed and the sorted file is binary
+// searched, neither is loaded into memory. Blank lines are skipped.
+type Store struct {
+	path  string
+	isDir bool
+}
+
+func Open(path string) (*Store, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open pwned passwords list")
+	}
+	return &Store{path: path, isDir: info.IsDir()}, nil
+}
+
+// Hash returns the upper case hex SHA-1 of password as in the lists
+func Hash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Lookup returns times each hash is seen in breaches, hashes not found
+// are left out.
+func (s *Store) Lookup(hashes []string) (map[string]int64, error) {
+	uniq := map[string]struct{}{}
+	for _, h := range hashes {
+		if len(h) != hashLen {
+			return nil, errors.Errorf("invalid SHA-1 hash %q", h)
+		}
+		uniq[strings.ToUpper(h)] = struct{}{}
+	}
+	sorted := make([]string, 0, len(uniq))
+	for h := range uniq {
+		sorted = append(sorted, h)
+	}
+	sort.Strings(sorted)
+
+	if s.isDir {
+		return s.lookupRanges(sorted)
+	}
+	return s.lookupSorted(sorted)
+}
+
+var errNotSorted = errors.New("pwned passwords file is not sorted by hash")
+
+// lookupSorted binary searches each hash in the sorted file by seeking,
+// searches of later hashes start from the previous one
+func (s *Store) lookupSorted(hashes []string) (map[string]int64, error) {
+	found := map[string]int64{}
+	if len(hashes) == 0 {
+		return found, nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open pwned passwords file")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to stat pwned passwords file")
+	}
+	sf := &sortedFile{f: f, size: info.Size()}
+
+	lo, loHash := int64(0), ""
+	for _, h := range hashes {
+		line, start, err := sf.search(h, lo, loHash)
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			// beyond the last line, so are the rest
+			break
+		}
+		if line.hash == h && line.count > 0 {
+			found[h] = line.count
+		}
+		lo, loHash = start, line.hash
+	}
+	return found, nil
+}
+
+// sortedFile is a file of "HASH:COUNT" lines sorted by hash
+type sortedFile struct {
+	f    *os.File
+	size int64
+}
+
+type sortedLine struct {
+	hash  string
+	count int64
+	// offset after the line
+	next int64
+}
+
+// search finds the first line at or after offset lo whose hash is not less
+// than h, nil if none. Lines out of order met on the way fail with
+// errNotSorted, but not every unsorted file is caught.
+func (s *sortedFile) search(h string, lo int64, loHash string) (*sortedLine, int64, error) {
+	hi, hiHash := s.size, ""
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, err := s.lineFrom(mid)
+		if err != nil {
+			return nil, 0, err
+		}
+		if line != nil && (line.hash < loHash || (hiHash != "" && line.hash > hiHash)) {
+			return nil, 0, errNotSorted
+		}
+		if line == nil || line.hash >= h {
+			hi, hiHash = mid, ""
+			if line != nil {
+				hiHash = line.hash
+			}
+		} else {
+			lo, loHash = line.next, line.hash
+		}
+	}
+	line, err := s.lineFrom(lo)
+	if err != nil || line == nil {
+		return nil, 0, err
+	}
+	if line.hash < loHash {
+		return nil, 0, errNotSorted
+	}
+	return line, lo, nil
+}
+
+// lineFrom reads the first non blank line starting at or after off, nil
+// at the end of file
+func (s *sortedFile) lineFrom(off int64) (*sortedLine, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(s.f, off, s.size-off), 128)
+	if off > 0 {
+		// skip the rest of the line off is in
+		prev := make([]byte, 1)
+		if _, err := s.f.ReadAt(prev, off-1); err != nil {
+			return nil, errors.Wrap(err, "fail to read pwned passwords file")
+		}
+		if prev[0] != '\n' {
+			rest, err := r.ReadString('\n')
+			off += int64(len(rest))
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "fail to read pwned passwords file")
+			}
+		}
+	}
+	for {
+		text, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "fail to read pwned passwords file")
+		}
+		off += int64(len(text))
+		if strings.TrimSpace(text) != "" {
+			hash, count, err := parseLine(text)
+			if err != nil {
+				return nil, err
+			}
+			if len(hash) != hashLen {
+				return nil, errors.Errorf("invalid line of pwned passwords file %q", text)
+			}
+			return &sortedLine{hash: hash, count: count, next: off}, nil
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+	}
+}
+
+// lookupRanges scans the range file of each prefix once
+func (s *Store) lookupRanges(hashes []string) (map[string]int64, error) {
+	found := map[string]int64{}
+	for start := 0; start < len(hashes); {
+		prefix := hashes[start][:prefixLen]
+		end := start
+		suffixes := map[string]string{}
+		for end < len(hashes) && hashes[end][:prefixLen] == prefix {
+			suffixes[hashes[end][prefixLen:]] = hashes[end]
+			end++
+		}
+		if err := s.scanRange(prefix, suffixes, found); err != nil {
+			return nil, err
+		}
+		start = end
+	}
+	return found, nil
+}
+
+func (s *Store) scanRange(prefix string, suffixes map[string]string, found map[string]int64) error {
+	// the official downloader names files with .txt
+	f, err := os.Open(filepath.Join(s.path, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(s.path, prefix))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "fail to open range file of %s", prefix)
+	}
+	defer f.Close()
+
+	remaining := len(suffixes)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && remaining > 0 {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		suffix, count, err := parseLine(scanner.Text())
+		if err != nil {
+			return err
+		}
+		hash, ok := suffixes[suffix]
+		if !ok {
+			continue
+		}
+		remaining--
+		// padding entries of range API have zero count
+		if count > 0 {
+			found[hash] = count
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "fail to read range file of %s", prefix)
+	}
+	return nil
+}
+
+func parseLine(line string) (string, int64, error) {
+	hash, count, ok := strings.Cut(strings.TrimSpace(line), ":")
+	if !ok {
+		return "", 0, errors.Errorf("invalid line of pwned passwords list %q", line)
+	}
+	n, err := strconv.ParseInt(count, 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "invalid count of pwned passwords list %q", line)
+	}
+	return strings.ToUpper(hash), n, nil
+}
@@ -0,0 +1,161 @@
+package hibp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	pwned   = map[string]int64{"password": 10, "123456": 20, "qwerty": 30}
+	padding = "dummy-padding"
+	unseen  = "never-pwned-c4d2"
+)
+
+// writeRanges writes range files of pwned and a zero count padding entry,
+// with blank lines, named prefix+ext
+func writeRanges(t *testing.T, ext string) string {
+	dir := t.TempDir()
+	lines := map[string][]string{}
+	add := func(pw string, count int64) {
+		h := Hash(pw)
+		lines[h[:prefixLen]] = append(lines[h[:prefixLen]], fmt.Sprintf("%s:%d", h[prefixLen:], count))
+	}
+	for pw, count := range pwned {
+		add(pw, count)
+	}
+	add(padding, 0)
+	for prefix, ls := range lines {
+		body := "\n" + strings.Join(ls, "\r\n") + "\n\n"
+		if err := os.WriteFile(filepath.Join(dir, prefix+ext), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// writeSorted writes pwned with filler hashes sorted in one file, with a
+// zero count padding entry and blank lines
+func writeSorted(t *testing.T, sorted bool) string {
+	ls := []string{fmt.Sprintf("%s:0", Hash(padding))}
+	for pw, count := range pwned {
+		ls = append(ls, fmt.Sprintf("%s:%d", Hash(pw), count))
+	}
+	for i := 0; i < 500; i++ {
+		ls = append(ls, fmt.Sprintf("%s:%d", Hash(fmt.Sprintf("filler-%d", i)), i+1))
+	}
+	sort.Strings(ls)
+	if !sorted {
+		sort.Sort(sort.Reverse(sort.StringSlice(ls)))
+	}
+	for i := 50; i < len(ls); i += 100 {
+		ls[i] += "\n"
+	}
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1-ordered-by-hash.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(ls, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		path func(t *testing.T) string
+	}{
+		{"range files with .txt", func(t *testing.T) string { return writeRanges(t, ".txt") }},
+		{"range files without extension", func(t *testing.T) string { return writeRanges(t, "") }},
+		{"sorted file", func(t *testing.T) string { return writeSorted(t, true) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open(tt.path(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hashes := []string{Hash(padding)}
+			for pw := range pwned {
+				// lower case hashes are accepted
+				hashes = append(hashes, strings.ToLower(Hash(pw)))
+			}
+			if !s.isDir {
+				// misses before, between and after lines of the file
+				hashes = append(hashes, strings.Repeat("0", hashLen), strings.Repeat("F", hashLen), Hash(unseen))
+			}
+			found, err := s.Lookup(hashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(found) != len(pwned) {
+				t.Fatalf("found %d hashes, want %d: %v", len(found), len(pwned), found)
+			}
+			for pw, count := range pwned {
+				if found[Hash(pw)] != count {
+					t.Fatalf("count of %s = %d, want %d", pw, found[Hash(pw)], count)
+				}
+			}
+			if _, ok := found[Hash(padding)]; ok {
+				t.Fatal("zero count padding is found")
+			}
+		})
+	}
+}
+
+func TestLookupSortedFillers(t *testing.T) {
+	s, err := Open(writeSorted(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []string{}
+	for i := 0; i < 500; i += 7 {
+		hashes = append(hashes, Hash(fmt.Sprintf("filler-%d", i)))
+	}
+	found, err := s.Lookup(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i += 7 {
+		if got := found[Hash(fmt.Sprintf("filler-%d", i))]; got != int64(i+1) {
+			t.Fatalf("count of filler-%d = %d, want %d", i, got, i+1)
+		}
+	}
+}
+
+func TestLookupUnsortedFile(t *testing.T) {
+	s, err := Open(writeSorted(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Lookup([]string{Hash("password")})
+	if !errors.Is(err, errNotSorted) {
+		t.Fatalf("err = %v, want %v", err, errNotSorted)
+	}
+}
+
+func TestLookupMissingRange(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup([]string{Hash("password")}); err == nil {
+		t.Fatal("want error of missing range file")
+	}
+}
+
+func TestLookupInvalidHash(t *testing.T) {
+	s, err := Open(writeSorted(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Lookup([]string{"ABC"}); err == nil {
+		t.Fatal("want error of invalid hash")
+	}
+}
@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const (
+	ctxLogger = "logger"
+	ctxCaller = "log_caller"
+
+	HeaderRequestID = "X-Request-ID"
+
+	redacted = "[REDACTED]"
+)
+
+// keys whose values are never written, compared in lower case
+var redactKeys = map[string]bool{
+	"password":         true,
+	"new_password":     true,
+	"master_password":  true,
+	"initial_password": true,
+	"password_hash":    true,
+	"token":            true,
+	"access_token":     true,
+	"api_key":          true,
+	"x-api-key":        true,
+	"authorization":    true,
+	"secret":           true,
+	"value":            true,
+	"plaintext":        true,
+	"decrypted":        true,
+	"key":              true,
+	"sym_key":          true,
+}
+
+// Redacted reports whether values of key are hidden from logs
+func Redacted(key string) bool {
+	return redactKeys[strings.ToLower(key)]
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if Redacted(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// New creates a JSON logger hiding values of secret keys
+func New(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// Setup makes the JSON logger to stderr default, also for the standard
+// log package
+func Setup() *slog.Logger {
+	logger := New(os.Stderr)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// Fatal logs at error level then exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Middleware logs a line per request with the route instead of the path,
+// paths have emails and other identifiers.
+func Middleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		reqID := c.GetHeader(HeaderRequestID)
+		if reqID == "" || len(reqID) > 64 {
+			reqID = uuid.NewString()
+		}
+		c.Header(HeaderRequestID, reqID)
+		c.Set(ctxLogger, logger.With("request_id", reqID))
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			// not matched, e.g. proxied requests
+			route = c.Request.URL.Path
+		}
+		attrs := []any{
+			"method", c.Request.Method,
+			"route", route,
+			"status", c.Writer.Status(),
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		if caller := c.GetString(ctxCaller); caller != "" {
+			attrs = append(attrs, "caller", caller)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+		From(c).Info("request", attrs...)
+	}
+}
+
+// SetCaller records the authenticated caller in the request log
+func SetCaller(c *gin.Context, name string) {
+	c.Set(ctxCaller, name)
+}
+
+// From returns the logger of the request, or the default one
+func From(ctx context.Context) *slog.Logger {
+	if c, ok := ctx.(*gin.Context); ok {
+		if l, ok := c.Get(ctxLogger); ok {
+			if logger, ok := l.(*slog.Logger); ok {
+				return logger
+			}
+		}
+	}
+	return slog.Default()
+}
+
+// GormLogger writes warnings and errors of gorm without query parameters,
+// parameters have password hashes and keys.
+func GormLogger(logger *slog.Logger) gormlogger.Interface {
+	return gormlogger.New(
+		slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		gormlogger.Config{
+			SlowThreshold:             time.Second,
+			LogLevel:                  gormlogger.Warn,
+			IgnoreRecordNotFoundError: true,
+			ParameterizedQueries:      true,
+			Colorful:                  false,
+		},
+	)
+}
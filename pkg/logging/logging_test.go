@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const secretValue = "s3cr3t-must-not-leak"
+
+func TestRedactedKeysNeverWritten(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(l *slog.Logger)
+	}{
+		{"top level", func(l *slog.Logger) { l.Info("msg", "password", secretValue) }},
+		{"upper case", func(l *slog.Logger) { l.Info("msg", "X-Api-Key", secretValue) }},
+		{"with", func(l *slog.Logger) { l.With("token", secretValue).Info("msg") }},
+		{"group", func(l *slog.Logger) { l.Info("msg", slog.Group("user", "master_password", secretValue)) }},
+		{"with group", func(l *slog.Logger) { l.WithGroup("req").Info("msg", "authorization", secretValue) }},
+		{"bytes", func(l *slog.Logger) { l.Info("msg", "sym_key", []byte(secretValue)) }},
+		{"error level", func(l *slog.Logger) { l.Error("msg", "secret", secretValue) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			tt.log(New(&buf))
+
+			out := buf.String()
+			if strings.Contains(out, secretValue) {
+				t.Fatalf("secret written: %s", out)
+			}
+			if !strings.Contains(out, redacted) {
+				t.Fatalf("missing %s: %s", redacted, out)
+			}
+			if !json.Valid(bytes.TrimSpace(buf.Bytes())) {
+				t.Fatalf("not JSON: %s", out)
+			}
+		})
+	}
+}
+
+func TestOtherKeysWritten(t *testing.T) {
+	buf := bytes.Buffer{}
+	New(&buf).Info("msg", "email", "test01@foobar.com", "keys", 3)
+
+	line := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["email"] != "test01@foobar.com" {
+		t.Fatalf("email = %v", line["email"])
+	}
+	// only exact keys are redacted
+	if line["keys"] != float64(3) {
+		t.Fatalf("keys = %v", line["keys"])
+	}
+}
+
+func TestMiddlewareLogsRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	buf := bytes.Buffer{}
+	g := gin.New()
+	g.Use(Middleware(New(&buf)))
+	g.GET("/api/users/:email", func(c *gin.Context) {
+		SetCaller(c, "ci")
+		From(c).Info("try to get", "password", secretValue)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/test01@foobar.com", nil)
+	req.Header.Set(HeaderRequestID, "req-1")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+
+	out := buf.String()
+	for _, leak := range []string{secretValue, "test01@foobar.com"} {
+		if strings.Contains(out, leak) {
+			t.Fatalf("%s written: %s", leak, out)
+		}
+	}
+	if w.Header().Get(HeaderRequestID) != "req-1" {
+		t.Fatalf("request id = %q", w.Header().Get(HeaderRequestID))
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	line := map[string]any{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &line); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]any{
+		"route":      "/api/users/:email",
+		"request_id": "req-1",
+		"caller":     "ci",
+		"status":     float64(http.StatusOK),
+	} {
+		if line[k] != want {
+			t.Fatalf("%s = %v, want %v", k, line[k], want)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package mgr
+
+import (
+	"bytes"
+	"encoding/csv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+)
+
+const (
+	accessByUser       = "user"
+	accessByCollection = "collection"
+)
+
+type accessReportQuery struct {
+	OrgUUID string `form:"org_uuid" binding:"omitempty,uuid"`
+	By      string `form:"by" binding:"omitempty,oneof=user collection"`
+	Format  string `form:"format" binding:"omitempty,oneof=json csv"`
+}
+
+// accessGrant is the access of a confirmed member to a collection
+type accessGrant struct {
+	Email          string
+	OrgUUID        string
+	OrgName        string
+	CollectionUUID string
+	CollectionName string
+	Access         string
+	ItemCount      int64
+	Direct         bool
+	GroupUUIDs     *string
+	UserOrgType    int32
+	ByRole         bool
+	ByAccessAll    bool
+}
+
+// accessSource tells where access comes from, any of them may grant it.
+// Role is set for owners and admins, who can access all collections, and
+// AccessAll for memberships with access_all. Groups with access_all are
+// listed in Groups.
+type accessSource struct {
+	Direct    bool     `json:"direct"`
+	Groups    []string `json:"groups"`
+	Role      string   `json:"role,omitempty"`
+	AccessAll bool     `json:"access_all"`
+}
+
+type userAccessCollection struct {
+	OrgUUID        string `json:"org_uuid"`
+	OrgName        string `json:"org_name"`
+	CollectionUUID string `json:"collection_uuid"`
+	CollectionName string `json:"collection_name"`
+	Access         string `json:"access"`
+	ItemCount      int64  `json:"item_count"`
+	accessSource
+}
+
+type userAccess struct {
+	Email       string                 `json:"email"`
+	ItemCount   int64                  `json:"item_count"`
+	Collections []userAccessCollection `json:"collections"`
+}
+
+type collectionAccessMember struct {
+	Email  string `json:"email"`
+	Access string `json:"access"`
+	accessSource
+}
+
+type collectionAccessReport struct {
+	OrgUUID        string                   `json:"org_uuid"`
+	OrgName        string                   `json:"org_name"`
+	CollectionUUID string                   `json:"collection_uuid"`
+	CollectionName string                   `json:"collection_name"`
+	ItemCount      int64                    `json:"item_count"`
+	Members        []collectionAccessMember `json:"members"`
+}
+
+// accessGrants lists decrypted grants of all orgs, or the given one
+func (m *VMManager) accessGrants(orgUUID string) ([]accessGrant, map[string]string, error) {
+	grants := []accessGrant{}
+
+	sql := `
+	WITH collection_items AS (
+		SELECT
+			cc.collection_uuid,
+			count(*) AS item_count
+		FROM
+			ciphers_collections cc
+			INNER JOIN ciphers p ON p.uuid = cc.cipher_uuid
+		WHERE
+			p.deleted_at IS NULL
+		GROUP BY
+			1
+	)
+	SELECT
+		u.email,
+		c.org_uuid,
+		o.name AS org_name,
+		c.uuid AS collection_uuid,
+		c.name AS collection_name,
+		CASE
+			WHEN uce.manage = TRUE THEN 'manage'
+			WHEN uce.read_only = FALSE THEN 'edit'
+			ELSE 'view'
+		END AS access,
+		COALESCE(ci.item_count, 0) AS item_count,
+		uce.direct,
+		uce.group_uuids,
+		uce.user_org_type,
+		uce.by_role,
+		uce.by_access_all
+	FROM
+		users_collections_access uce
+		INNER JOIN collections c ON c.uuid = uce.collection_uuid
+		INNER JOIN organizations o ON o.uuid = c.org_uuid
+		INNER JOIN users u ON u.uuid = uce.user_uuid
+		LEFT JOIN collection_items ci ON ci.collection_uuid = c.uuid
+	WHERE
+		uce.user_org_status = ? AND (? = '' OR c.org_uuid = ?)
+	`
+	if err := m.db.Raw(sql, statusConfirmed, orgUUID, orgUUID).Scan(&grants).Error; err != nil {
+		return nil, nil, errors.Wrap(err, "fail to query access grants")
+	}
+
+	groups := []struct {
+		UUID string
+		Name string
+	}{}
+	err := m.db.Raw(`
+	SELECT
+		uuid,
+		name
+	FROM
+		groups
+	WHERE
+		? = '' OR organizations_uuid = ?
+	`, orgUUID, orgUUID).Scan(&groups).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fail to query groups")
+	}
+	groupNames := map[string]string{}
+	for _, g := range groups {
+		groupNames[g.UUID] = g.Name
+	}
+
+	colNames := map[string]string{}
+	for i := range grants {
+		g := &grants[i]
+		if name, ok := colNames[g.CollectionUUID]; ok {
+			g.CollectionName = name
+			continue
+		}
+		orgSymKey, err := m.orgSymKey(g.OrgUUID)
+		if err != nil {
+			return nil, nil, err
+		}
+		name, err := pkcs.BWSymDecrypt(orgSymKey, g.CollectionName)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "fail to decrypt name of collection %s", g.CollectionUUID)
+		}
+		g.CollectionName = string(name)
+		colNames[g.CollectionUUID] = g.CollectionName
+	}
+	return grants, groupNames, nil
+}
+
+// userItemCounts counts distinct items each confirmed member can see,
+// items in many collections are counted once
+func (m *VMManager) userItemCounts(orgUUID string) (map[string]int64, error) {
+	counts := []struct {
+		Email     string
+		ItemCount int64
+	}{}
+	err := m.db.Raw(`
+	SELECT
+		u.email,
+		count(DISTINCT cc.cipher_uuid) AS item_count
+	FROM
+		users_collections_access uce
+		INNER JOIN collections c ON c.uuid = uce.collection_uuid
+		INNER JOIN users u ON u.uuid = uce.user_uuid
+		INNER JOIN ciphers_collections cc ON cc.collection_uuid = c.uuid
+		INNER JOIN ciphers p ON p.uuid = cc.cipher_uuid
+	WHERE
+		uce.user_org_status = ? AND p.deleted_at IS NULL AND (? = '' OR c.org_uuid = ?)
+	GROUP BY
+		1
+	`, statusConfirmed, orgUUID, orgUUID).Scan(&counts).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to count user items")
+	}
+	results := map[string]int64{}
+	for _, c := range counts {
+		results[c.Email] = c.ItemCount
+	}
+	return results, nil
+}
+
+func (g *accessGrant) source(groupNames map[string]string) accessSource {
+	s := accessSource{Direct: g.Direct, Groups: []string{}, AccessAll: g.ByAccessAll}
+	if g.ByRole {
+		s.Role = roleID2Name[g.UserOrgType]
+	}
+	if g.GroupUUIDs == nil {
+		return s
+	}
+	for _, u := range strings.Split(*g.GroupUUIDs, ",") {
+		name, ok := groupNames[u]
+		if !ok {
+			name = u
+		}
+		s.Groups = append(s.Groups, name)
+	}
+	sort.Strings(s.Groups)
+	return s
+}
+
+func sortGrants(grants []accessGrant, by string) {
+	sort.Slice(grants, func(i, j int) bool {
+		a, b := grants[i], grants[j]
+		if by == accessByCollection {
+			if a.OrgName != b.OrgName {
+				return a.OrgName < b.OrgName
+			}
+			if a.CollectionName != b.CollectionName {
+				return a.CollectionName < b.CollectionName
+			}
+			if a.CollectionUUID != b.CollectionUUID {
+				return a.CollectionUUID < b.CollectionUUID
+			}
+			return a.Email < b.Email
+		}
+		if a.Email != b.Email {
+			return a.Email < b.Email
+		}
+		if a.OrgName != b.OrgName {
+			return a.OrgName < b.OrgName
+		}
+		return a.CollectionName < b.CollectionName
+	})
+}
+
+func (m *VMManager) accessByUser(orgUUID string) ([]userAccess, error) {
+	grants, groupNames, err := m.accessGrants(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := m.userItemCounts(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	sortGrants(grants, accessByUser)
+
+	results := []userAccess{}
+	for i := range grants {
+		g := &grants[i]
+		if len(results) == 0 || results[len(results)-1].Email != g.Email {
+			results = append(results, userAccess{
+				Email:       g.Email,
+				ItemCount:   counts[g.Email],
+				Collections: []userAccessCollection{},
+			})
+		}
+		r := &results[len(results)-1]
+		r.Collections = append(r.Collections, userAccessCollection{
+			OrgUUID:        g.OrgUUID,
+			OrgName:        g.OrgName,
+			CollectionUUID: g.CollectionUUID,
+			CollectionName: g.CollectionName,
+			Access:         g.Access,
+			ItemCount:      g.ItemCount,
+			accessSource:   g.source(groupNames),
+		})
+	}
+	return results, nil
+}
+
+func (m *VMManager) accessByCollection(orgUUID string) ([]collectionAccessReport, error) {
+	grants, groupNames, err := m.accessGrants(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	sortGrants(grants, accessByCollection)
+
+	results := []collectionAccessReport{}
+	for i := range grants {
+		g := &grants[i]
+		if len(results) == 0 || results[len(results)-1].CollectionUUID != g.CollectionUUID {
+			results = append(results, collectionAccessReport{
+				OrgUUID:        g.OrgUUID,
+				OrgName:        g.OrgName,
+				CollectionUUID: g.CollectionUUID,
+				CollectionName: g.CollectionName,
+				ItemCount:      g.ItemCount,
+				Members:        []collectionAccessMember{},
+			})
+		}
+		r := &results[len(results)-1]
+		r.Members = append(r.Members, collectionAccessMember{
+			Email:        g.Email,
+			Access:       g.Access,
+			accessSource: g.source(groupNames),
+		})
+	}
+	return results, nil
+}
+
+// accessReportCSV flattens the report into one row per member and
+// collection, columns are ordered by the pivot
+func (m *VMManager) accessReportCSV(orgUUID, by string) ([]byte, error) {
+	grants, groupNames, err := m.accessGrants(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	sortGrants(grants, by)
+
+	buf := bytes.Buffer{}
+	w := csv.NewWriter(&buf)
+	header := []string{"email", "org_uuid", "org_name", "collection_uuid", "collection_name", "access", "item_count", "direct", "groups", "role", "access_all"}
+	if by == accessByCollection {
+		header = []string{"org_uuid", "org_name", "collection_uuid", "collection_name", "item_count", "email", "access", "direct", "groups", "role", "access_all"}
+	}
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for i := range grants {
+		g := &grants[i]
+		s := g.source(groupNames)
+		row := map[string]string{
+			"email":           g.Email,
+			"org_uuid":        g.OrgUUID,
+			"org_name":        g.OrgName,
+			"collection_uuid": g.CollectionUUID,
+			"collection_name": g.CollectionName,
+			"access":          g.Access,
+			"item_count":      strconv.FormatInt(g.ItemCount, 10),
+			"direct":          strconv.FormatBool(s.Direct),
+			"groups":          strings.Join(s.Groups, ";"),
+			"role":            s.Role,
+			"access_all":      strconv.FormatBool(s.AccessAll),
+		}
+		record := make([]string, len(header))
+		for j, h := range header {
+			record[j] = row[h]
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,26 @@
+package mgr
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// writeAudit records an operation in the same transaction of it
+func writeAudit(tx *gorm.DB, actor, action, target string, detail interface{}) error {
+	bs, err := json.Marshal(detail)
+	if err != nil {
+		return errors.Wrap(err, "fail to marshal audit detail")
+	}
+	entry := model.MgrAuditLog{
+		CreatedAt: time.Now().UTC(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Detail:    string(bs),
+	}
+	return tx.Create(&entry).Error
+}
@@ -0,0 +1,245 @@
+package mgr
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	maxBulkRows = 1000
+
+	BulkFormatCSV  = "csv"
+	BulkFormatJSON = "json"
+)
+
+var (
+	errInvalidBulk    = errors.New("invalid bulk users")
+	errBulkRolledBack = errors.New("rolled back by failure of other rows")
+)
+
+type bulkQuery struct {
+	Atomic bool `form:"atomic"`
+}
+
+// BulkResult is the result of a row, Row counts from 1
+type BulkResult struct {
+	Row    int    `json:"row"`
+	Email  string `json:"email"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parseBulkUsers reads a JSON array of users, or CSV with header
+// email,name,password and optional org_info and kdf columns.
+// org_info is ';' separated <org_uuid>:<role>, kdf is the type name.
+// Passwords are generated for empty password of CSV.
+func parseBulkUsers(r io.Reader, format string) ([]userInfo, error) {
+	users := []userInfo{}
+	switch format {
+	case BulkFormatJSON:
+		if err := json.NewDecoder(r).Decode(&users); err != nil {
+			return nil, errors.Wrapf(errInvalidBulk, "fail to decode JSON: %v", err)
+		}
+	case BulkFormatCSV:
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, errors.Wrapf(errInvalidBulk, "fail to read CSV: %v", err)
+		}
+		if len(records) == 0 {
+			return nil, errors.Wrap(errInvalidBulk, "missing CSV header")
+		}
+		col := map[string]int{}
+		for i, h := range records[0] {
+			col[strings.TrimSpace(h)] = i
+		}
+		for _, h := range []string{"email", "name", "password"} {
+			if _, ok := col[h]; !ok {
+				return nil, errors.Wrapf(errInvalidBulk, "missing CSV column %s", h)
+			}
+		}
+		for _, rec := range records[1:] {
+			u := userInfo{
+				Email:    rec[col["email"]],
+				Name:     rec[col["name"]],
+				Password: rec[col["password"]],
+				OrgInfo:  []orgInfo{},
+			}
+			u.GeneratePassword = u.Password == ""
+			if i, ok := col["org_info"]; ok {
+				for _, o := range strings.Split(rec[i], ";") {
+					if o = strings.TrimSpace(o); o == "" {
+						continue
+					}
+					orgUUID, role, _ := strings.Cut(o, ":")
+					u.OrgInfo = append(u.OrgInfo, orgInfo{UUID: orgUUID, Role: role})
+				}
+			}
+			if i, ok := col["kdf"]; ok && rec[i] != "" {
+				u.Kdf = &kdfInfo{Type: rec[i]}
+			}
+			users = append(users, u)
+		}
+	default:
+		return nil, errors.Wrapf(errInvalidBulk, "unsupported format %s", format)
+	}
+
+	if len(users) > maxBulkRows {
+		return nil, errors.Wrapf(errInvalidBulk, "more than %d rows", maxBulkRows)
+	}
+	return users, nil
+}
+
+// BulkCreateUsers creates users of a CSV or JSON file with full privileges,
+// it is for the command line.
+func (m *VMManager) BulkCreateUsers(r io.Reader, format string, atomic bool) ([]BulkResult, error) {
+	users, err := parseBulkUsers(r, format)
+	if err != nil {
+		return nil, err
+	}
+	caller := &apiKey{Name: "cli", Scopes: []string{scopeAll}}
+	return m.bulkCreateUsers(users, atomic, caller), nil
+}
+
+// bulkCreateUsers derives keys in a bounded worker pool. Rows are created
+// in their own transactions, or in one transaction if atomic. Existing
+// users are never overwritten.
+func (m *VMManager) bulkCreateUsers(users []userInfo, atomic bool, caller *apiKey) []BulkResult {
+	results := make([]BulkResult, len(users))
+	keys := make([]*userKeys, len(users))
+	org2roles := make([]map[string]int32, len(users))
+
+	seen := map[string]int{}
+	for i, u := range users {
+		results[i] = BulkResult{Row: i + 1, Email: u.Email}
+		if row, ok := seen[u.Email]; ok {
+			results[i].Error = errors.Wrapf(errInvalidBulk, "duplicated email of row %d", row).Error()
+		}
+		seen[u.Email] = i + 1
+	}
+
+	prepare := func(i int) error {
+		u := users[i]
+		if err := binding.Validator.ValidateStruct(&u); err != nil {
+			return err
+		}
+		if err := u.checkPassword(); err != nil {
+			return err
+		}
+		if u.GeneratePassword && m.mailer == nil {
+			return errNoMailer
+		}
+		kdf := pkcs.DefaultKdfParams(pkcs.KdfPBKDF2)
+		if u.Kdf != nil {
+			var err error
+			if kdf, err = u.Kdf.params(); err != nil {
+				return err
+			}
+		}
+		org2role := map[string]int32{}
+		for _, o := range u.OrgInfo {
+			org2role[o.UUID] = roleName2ID[o.Role]
+			if err := checkRoleGrant(caller, org2role[o.UUID]); err != nil {
+				return err
+			}
+		}
+		k, err := newUserKeys(u.Email, u.Name, u.Password, kdf)
+		if err != nil {
+			return err
+		}
+		keys[i], org2roles[i] = k, org2role
+		if atomic {
+			return nil
+		}
+		var mail *initialPasswordMail
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			_, mail, err = m.insertUser(tx, k, org2role, caller.Name, false)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := m.sendInitialPasswords(mail); err != nil {
+			results[i].Status = "created"
+			return err
+		}
+		return nil
+	}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < min(runtime.NumCPU(), len(users)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := prepare(i); err != nil {
+					results[i].Error = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range users {
+		if results[i].Error == "" {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if atomic {
+		failed := false
+		for _, r := range results {
+			failed = failed || r.Error != ""
+		}
+		if !failed {
+			mails := make([]*initialPasswordMail, len(users))
+			err := m.db.Transaction(func(tx *gorm.DB) error {
+				for i := range users {
+					var err error
+					if _, mails[i], err = m.insertUser(tx, keys[i], org2roles[i], caller.Name, false); err != nil {
+						results[i].Error = err.Error()
+						return err
+					}
+				}
+				return nil
+			})
+			failed = err != nil
+			// generated passwords are only mailed after all rows are committed
+			for i := 0; !failed && i < len(mails); i++ {
+				if err := m.sendInitialPasswords(mails[i]); err != nil {
+					results[i].Status, results[i].Error = "created", err.Error()
+				}
+			}
+		}
+		if failed {
+			for i := range results {
+				if results[i].Error == "" {
+					results[i].Error = errBulkRolledBack.Error()
+				}
+			}
+		}
+	}
+
+	for i := range results {
+		// created rows failing to mail keep their error
+		if results[i].Status != "" {
+			continue
+		}
+		if results[i].Error == "" {
+			results[i].Status = "created"
+		} else {
+			results[i].Status = "failed"
+		}
+	}
+	return results
+}
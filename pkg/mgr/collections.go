@@ -0,0 +1,385 @@
+package mgr
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type orgCollection struct {
+	OrgUUID        string `uri:"org_uuid" binding:"required,uuid"`
+	CollectionUUID string `uri:"collection_uuid" binding:"required,uuid"`
+}
+
+type orgCollectionUser struct {
+	orgCollection
+	Email string `uri:"email" binding:"required,email,max=64"`
+}
+
+type orgCollectionGroup struct {
+	orgCollection
+	GroupUUID string `uri:"group_uuid" binding:"required,uuid"`
+}
+
+type collectionInfo struct {
+	Name       string  `json:"name" binding:"required,max=1000"`
+	ExternalID *string `json:"external_id" binding:"omitempty,max=300"`
+}
+
+type collectionAccess struct {
+	ReadOnly      bool `json:"read_only"`
+	HidePasswords bool `json:"hide_passwords"`
+	Manage        bool `json:"manage"`
+}
+
+type collectionUser struct {
+	CollectionUUID string `json:"-"`
+	Email          string `json:"email"`
+	collectionAccess
+}
+
+type collectionGroup struct {
+	CollectionUUID string `json:"-"`
+	GroupUUID      string `json:"group_uuid"`
+	GroupName      string `json:"group_name"`
+	collectionAccess
+}
+
+// collectionMember is the effective access of user, directly or by groups
+type collectionMember struct {
+	CollectionUUID string `json:"-"`
+	Email          string `json:"email"`
+	ReadOnly       bool   `json:"read_only"`
+	Manage         bool   `json:"manage"`
+	Status         string `json:"status"`
+
+	UserOrgStatus int32 `json:"-"`
+}
+
+type collectionDetail struct {
+	UUID       string             `json:"uuid"`
+	Name       string             `json:"name"`
+	ExternalID *string            `json:"external_id"`
+	Users      []collectionUser   `json:"users"`
+	Groups     []collectionGroup  `json:"groups"`
+	Members    []collectionMember `json:"members"`
+}
+
+func (m *VMManager) orgSymKey(orgUUID string) ([]byte, error) {
+	orgSymKey, ok := m.orgSymKeys[orgUUID]
+	if !ok {
+		return nil, errors.Wrapf(gorm.ErrRecordNotFound, "fail to found org symmetric key of %s", orgUUID)
+	}
+	return orgSymKey, nil
+}
+
+func (m *VMManager) listCollections(orgUUID string) ([]collectionDetail, error) {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := []model.Collection{}
+	if err := m.db.Where("org_uuid = ?", orgUUID).Find(&cols).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query collections")
+	}
+
+	users := []collectionUser{}
+	err = m.db.Raw(`
+	SELECT
+		uc.collection_uuid,
+		u.email,
+		uc.read_only,
+		uc.hide_passwords,
+		uc.manage
+	FROM
+		users_collections uc
+		INNER JOIN collections c ON c.uuid = uc.collection_uuid
+		INNER JOIN users u ON u.uuid = uc.user_uuid
+	WHERE
+		c.org_uuid = ?
+	ORDER BY
+		u.email
+	`, orgUUID).Scan(&users).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query collection users")
+	}
+
+	groups := []collectionGroup{}
+	err = m.db.Raw(`
+	SELECT
+		cg.collections_uuid AS collection_uuid,
+		g.uuid AS group_uuid,
+		g.name AS group_name,
+		cg.read_only,
+		cg.hide_passwords,
+		cg.manage
+	FROM
+		collections_groups cg
+		INNER JOIN groups g ON g.uuid = cg.groups_uuid
+	WHERE
+		g.organizations_uuid = ?
+	ORDER BY
+		g.name
+	`, orgUUID).Scan(&groups).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query collection groups")
+	}
+
+	members := []collectionMember{}
+	err = m.db.Raw(`
+	SELECT
+		uce.collection_uuid,
+		u.email,
+		uce.read_only,
+		uce.manage,
+		uce.user_org_status
+	FROM
+		users_collections_access uce
+		INNER JOIN collections c ON c.uuid = uce.collection_uuid
+		INNER JOIN users u ON u.uuid = uce.user_uuid
+	WHERE
+		c.org_uuid = ?
+	ORDER BY
+		u.email
+	`, orgUUID).Scan(&members).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query collection members")
+	}
+
+	results := make([]collectionDetail, 0, len(cols))
+	idx := map[string]int{}
+	for _, c := range cols {
+		name, err := pkcs.BWSymDecrypt(orgSymKey, c.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to decrypt name of collection %s", c.UUID)
+		}
+		idx[c.UUID] = len(results)
+		results = append(results, collectionDetail{
+			UUID:       c.UUID,
+			Name:       string(name),
+			ExternalID: c.ExternalID,
+			Users:      []collectionUser{},
+			Groups:     []collectionGroup{},
+			Members:    []collectionMember{},
+		})
+	}
+	for _, u := range users {
+		d := &results[idx[u.CollectionUUID]]
+		d.Users = append(d.Users, u)
+	}
+	for _, g := range groups {
+		d := &results[idx[g.CollectionUUID]]
+		d.Groups = append(d.Groups, g)
+	}
+	for _, cm := range members {
+		cm.Status = statusName(cm.UserOrgStatus)
+		d := &results[idx[cm.CollectionUUID]]
+		d.Members = append(d.Members, cm)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (m *VMManager) createCollection(orgUUID string, info collectionInfo) (string, error) {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return "", err
+	}
+
+	col := model.Collection{
+		UUID:       uuid.NewString(),
+		OrgUUID:    orgUUID,
+		Name:       pkcs.BWSymEncrypt(orgSymKey, []byte(info.Name)),
+		ExternalID: info.ExternalID,
+	}
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&col).Error; err != nil {
+			return err
+		}
+		return touchOrgUsers(tx, orgUUID, time.Now().UTC())
+	})
+	if err != nil {
+		return "", err
+	}
+	return col.UUID, nil
+}
+
+func (m *VMManager) updateCollection(orgUUID, colUUID string, info collectionInfo) error {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return err
+	}
+
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&model.Collection{}).
+			Where("uuid = ? AND org_uuid = ?", colUUID, orgUUID).
+			Updates(map[string]interface{}{
+				"name":        pkcs.BWSymEncrypt(orgSymKey, []byte(info.Name)),
+				"external_id": info.ExternalID,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.Wrapf(gorm.ErrRecordNotFound, "collection %s is not found in org %s", colUUID, orgUUID)
+		}
+		return touchOrgUsers(tx, orgUUID, time.Now().UTC())
+	})
+}
+
+// deleteCollection removes the collection with its assignments, items are
+// kept in org like Vaultwarden does.
+func (m *VMManager) deleteCollection(orgUUID, colUUID string) ([]stepResult, error) {
+	r := stepRunner{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		r.tx = tx
+		if err := checkOrgCollections(tx, orgUUID, []string{colUUID}); err != nil {
+			return err
+		}
+
+		steps := []struct {
+			name string
+			fn   func(tx *gorm.DB) *gorm.DB
+		}{
+			{"remove_users", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec("DELETE FROM users_collections WHERE collection_uuid = ?", colUUID)
+			}},
+			{"remove_groups", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec("DELETE FROM collections_groups WHERE collections_uuid = ?", colUUID)
+			}},
+			{"remove_items", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec("DELETE FROM ciphers_collections WHERE collection_uuid = ?", colUUID)
+			}},
+			{"delete_collection", func(tx *gorm.DB) *gorm.DB {
+				return tx.Delete(&model.Collection{}, "uuid = ?", colUUID)
+			}},
+		}
+		for _, s := range steps {
+			if err := r.run(s.name, s.fn); err != nil {
+				return err
+			}
+		}
+		return touchOrgUsers(tx, orgUUID, time.Now().UTC())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.results, nil
+}
+
+// setCollectionUser assigns collection to a member of org directly
+func (m *VMManager) setCollectionUser(orgUUID, colUUID, email string, access collectionAccess) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgCollections(tx, orgUUID, []string{colUUID}); err != nil {
+			return err
+		}
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_uuid = ? AND org_uuid = ?", user.UUID, orgUUID).
+			First(&model.UsersOrganization{}).Error
+		if err != nil {
+			return errors.Wrapf(err, "%s is not a member of org %s", email, orgUUID)
+		}
+
+		err = tx.Exec(`
+		INSERT INTO users_collections (user_uuid, collection_uuid, read_only, hide_passwords, manage)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_uuid, collection_uuid) DO UPDATE SET
+			read_only = EXCLUDED.read_only,
+			hide_passwords = EXCLUDED.hide_passwords,
+			manage = EXCLUDED.manage
+		`, user.UUID, colUUID, access.ReadOnly, access.HidePasswords, access.Manage).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+			Update("updated_at", time.Now().UTC()).Error
+	})
+}
+
+func (m *VMManager) removeCollectionUser(orgUUID, colUUID, email string) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgCollections(tx, orgUUID, []string{colUUID}); err != nil {
+			return err
+		}
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+		res := tx.Exec("DELETE FROM users_collections WHERE user_uuid = ? AND collection_uuid = ?", user.UUID, colUUID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.Wrapf(gorm.ErrRecordNotFound, "%s is not assigned to collection %s", email, colUUID)
+		}
+		return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+			Update("updated_at", time.Now().UTC()).Error
+	})
+}
+
+// checkOrgGroup makes sure the group belongs to the org
+func checkOrgGroup(tx *gorm.DB, orgUUID, groupUUID string) error {
+	var count int64
+	err := tx.Table("groups").
+		Where("uuid = ? AND organizations_uuid = ?", groupUUID, orgUUID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.Wrapf(gorm.ErrRecordNotFound, "group %s is not found in org %s", groupUUID, orgUUID)
+	}
+	return nil
+}
+
+func (m *VMManager) setCollectionGroup(orgUUID, colUUID, groupUUID string, access collectionAccess) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgCollections(tx, orgUUID, []string{colUUID}); err != nil {
+			return err
+		}
+		if err := checkOrgGroup(tx, orgUUID, groupUUID); err != nil {
+			return err
+		}
+
+		err := tx.Exec(`
+		INSERT INTO collections_groups (collections_uuid, groups_uuid, read_only, hide_passwords, manage)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (collections_uuid, groups_uuid) DO UPDATE SET
+			read_only = EXCLUDED.read_only,
+			hide_passwords = EXCLUDED.hide_passwords,
+			manage = EXCLUDED.manage
+		`, colUUID, groupUUID, access.ReadOnly, access.HidePasswords, access.Manage).Error
+		if err != nil {
+			return err
+		}
+		return touchOrgUsers(tx, orgUUID, time.Now().UTC())
+	})
+}
+
+func (m *VMManager) removeCollectionGroup(orgUUID, colUUID, groupUUID string) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgCollections(tx, orgUUID, []string{colUUID}); err != nil {
+			return err
+		}
+		res := tx.Exec("DELETE FROM collections_groups WHERE collections_uuid = ? AND groups_uuid = ?", colUUID, groupUUID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.Wrapf(gorm.ErrRecordNotFound, "group %s is not assigned to collection %s", groupUUID, colUUID)
+		}
+		return touchOrgUsers(tx, orgUUID, time.Now().UTC())
+	})
+}
@@ -0,0 +1,120 @@
+package mgr
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/vault"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type itemFieldInfo struct {
+	Name   string `json:"name" binding:"required,max=256"`
+	Value  string `json:"value" binding:"max=5000"`
+	Hidden bool   `json:"hidden"`
+}
+
+type orgItemInfo struct {
+	CollectionUUIDs []string        `json:"collection_uuids" binding:"required,min=1,dive,uuid"`
+	Name            string          `json:"name" binding:"required,max=1000"`
+	Username        string          `json:"username" binding:"max=1000"`
+	Password        string          `json:"password" binding:"max=5000"`
+	URIs            []string        `json:"uris" binding:"dive,min=1,max=10000"`
+	Notes           string          `json:"notes" binding:"max=10000"`
+	Fields          []itemFieldInfo `json:"fields" binding:"dive"`
+}
+
+func (i *orgItemInfo) cipher() *vault.Cipher {
+	v := &vault.Cipher{
+		Type:  vault.TypeLogin,
+		Name:  i.Name,
+		Notes: i.Notes,
+		Login: &vault.Login{
+			Username: i.Username,
+			Password: i.Password,
+		},
+	}
+	for _, u := range i.URIs {
+		v.Login.Uris = append(v.Login.Uris, vault.LoginURI{URI: u})
+	}
+	for _, f := range i.Fields {
+		field := vault.Field{Name: f.Name, Value: f.Value, Type: vault.FieldText}
+		if f.Hidden {
+			field.Type = vault.FieldHidden
+		}
+		v.Fields = append(v.Fields, field)
+	}
+	return v
+}
+
+func (m *VMManager) createOrgItem(orgUUID string, item orgItemInfo) (string, error) {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := vault.Encrypt(item.cipher(), orgSymKey)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	c.UUID = uuid.NewString()
+	c.OrganizationUUID = &orgUUID
+	c.CreatedAt, c.UpdatedAt = now, now
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgCollections(tx, orgUUID, item.CollectionUUIDs); err != nil {
+			return err
+		}
+		if err := tx.Create(c).Error; err != nil {
+			return err
+		}
+		for _, colUUID := range item.CollectionUUIDs {
+			cc := model.CiphersCollection{
+				CipherUUID:     c.UUID,
+				CollectionUUID: colUUID,
+			}
+			if err := tx.Create(&cc).Error; err != nil {
+				return err
+			}
+		}
+		return touchOrgUsers(tx, orgUUID, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return c.UUID, nil
+}
+
+// checkOrgCollections makes sure all collections belong to the org
+func checkOrgCollections(tx *gorm.DB, orgUUID string, colUUIDs []string) error {
+	uniq := map[string]struct{}{}
+	for _, u := range colUUIDs {
+		uniq[u] = struct{}{}
+	}
+
+	var count int64
+	err := tx.Model(&model.Collection{}).
+		Where("org_uuid = ? AND uuid IN ?", orgUUID, colUUIDs).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if int(count) != len(uniq) {
+		return errors.Wrapf(gorm.ErrRecordNotFound, "some collections are not found in org %s", orgUUID)
+	}
+	return nil
+}
+
+// touchOrgUsers bumps account revision of confirmed org members,
+// then Bitwarden clients know to sync.
+func touchOrgUsers(tx *gorm.DB, orgUUID string, now time.Time) error {
+	return tx.Model(&model.User{}).
+		Where("uuid IN (?)", tx.Model(&model.UsersOrganization{}).
+			Select("user_uuid").
+			Where("org_uuid = ? AND status = ?", orgUUID, statusConfirmed)).
+		Update("updated_at", now).Error
+}
@@ -1,6 +1,8 @@
 package mgr
 
 import (
+	"crypto/rsa"
+
 	"github.com/google/uuid"
 	"github.com/imtaco/vwmgr/pkg/model"
 	"github.com/imtaco/vwmgr/pkg/pkcs"
@@ -10,23 +12,76 @@ import (
 )
 
 const (
-	roleOwner  = 0
-	roleAdmin  = 1
-	roleUser   = 2
-	roleCustom = 3
+	roleOwner   = 0
+	roleAdmin   = 1
+	roleUser    = 2
+	roleManager = 3
 )
 
+// status of users_organizations
+const (
+	statusInvited   = 0
+	statusAccepted  = 1
+	statusConfirmed = 2
+	// Vaultwarden revokes by status - 128 and restores by + 128, so any
+	// negative status is revoked
+	statusRevokeDiff = 128
+)
+
+var errUserExists = errors.New("user already exists")
+
+// createUser creates user with memberships, or overwrites keys and
+// password of the existing user of the same email. An empty masterPassword
+// is generated and mailed once the user is committed.
 func (m *VMManager) createUser(
 	email string,
 	name string,
 	masterPassword string,
 	org2role map[string]int32,
+	kdf pkcs.KdfParams,
+	actor string,
 ) error {
-	userMasterKey := pkcs.DeriveMasterKey(email, masterPassword)
+	keys, err := newUserKeys(email, name, masterPassword, kdf)
+	if err != nil {
+		return err
+	}
+	var mail *initialPasswordMail
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		_, mail, err = m.insertUser(tx, keys, org2role, actor, true)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return m.sendInitialPasswords(mail)
+}
+
+// userKeys is a user row with derived password hash and generated keys
+type userKeys struct {
+	user model.User
+	pub  *rsa.PublicKey
+	// set if the password is generated, it is delivered to user
+	initialPassword string
+}
+
+// newUserKeys runs the expensive KDF and key generation out of any transaction,
+// a password is generated if masterPassword is empty.
+func newUserKeys(email, name, masterPassword string, kdf pkcs.KdfParams) (*userKeys, error) {
+	initialPassword := ""
+	if masterPassword == "" {
+		masterPassword = pkcs.GeneratePassword(initialPasswordLength)
+		initialPassword = masterPassword
+	}
+
+	userMasterKey, err := pkcs.DeriveMasterKey(email, masterPassword, kdf)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to derive master key")
+	}
 	passwordHash := pkcs.DerivePasswordHash(userMasterKey, masterPassword)
 
 	salt := pkcs.RandBytes(64)
-	hashPwdHash := pkcs.HashPasswordHash(passwordHash, salt)
+	hashPwdHash := pkcs.HashPasswordHash(passwordHash, salt, pkcs.DefaultPasswordIterations)
 
 	symKey := pkcs.RandBytes(64)
 	userAkey := pkcs.BWSymEncrypt(userMasterKey, symKey)
@@ -36,68 +91,89 @@ func (m *VMManager) createUser(
 
 	pubInf, err := pkcs.PublicKeyInfo(publicKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	user := model.User{
+		UUID:               uid,
+		Name:               name,
+		Email:              email,
+		PasswordHash:       hashPwdHash,
+		PasswordIterations: pkcs.DefaultPasswordIterations,
+		Salt:               salt,
+		Akey:               userAkey,
+		PublicKey:          pkcs.Base64Encode(publicKey),
+		PrivateKey:         pkcs.BWSymEncrypt(symKey, privateKey),
+		EquivalentDomains:  "[]",
+		ExcludedGlobals:    "[]",
+		SecurityStamp:      uuid.NewString(),
+		ClientKdfType:      int32(kdf.Type),
+		ClientKdfIter:      int32(kdf.Iterations),
+	}
+	if kdf.Type == pkcs.KdfArgon2id {
+		memory, parallelism := int32(kdf.Memory), int32(kdf.Parallelism)
+		user.ClientKdfMemory = &memory
+		user.ClientKdfParallelism = &parallelism
+	}
+	return &userKeys{user: user, pub: pubInf, initialPassword: initialPassword}, nil
+}
+
+func (m *VMManager) insertUser(
+	tx *gorm.DB,
+	keys *userKeys,
+	org2role map[string]int32,
+	actor string,
+	overwrite bool,
+) (*model.User, *initialPasswordMail, error) {
 	// check orgSymKey first
 	for orgUUID := range org2role {
 		if _, ok := m.orgSymKeys[orgUUID]; !ok {
-			return errors.Errorf("fail to found orr symmetric key of %s", orgUUID)
+			return nil, nil, errors.Errorf("fail to found orr symmetric key of %s", orgUUID)
 		}
 	}
 
-	return m.db.Transaction(func(tx *gorm.DB) error {
-		user := model.User{
-			UUID:               uid,
-			Name:               name,
-			Email:              email,
-			PasswordHash:       hashPwdHash,
-			PasswordIterations: pkcs.ITERATIONS,
-			Salt:               salt,
-			Akey:               userAkey,
-			PublicKey:          pkcs.Base64Encode(publicKey),
-			PrivateKey:         pkcs.BWSymEncrypt(symKey, privateKey),
-			EquivalentDomains:  "[]",
-			ExcludedGlobals:    "[]",
-			SecurityStamp:      uuid.NewString(),
-			ClientKdfIter:      pkcs.ITERATIONS,
-		}
-		// create if not found
-		err := tx.Clauses(
-			clause.Returning{Columns: []clause.Column{{Name: "uuid"}}},
-			clause.OnConflict{
-				Columns: []clause.Column{{Name: "email"}},
-				DoUpdates: clause.AssignmentColumns([]string{
-					"name",
-					"password_hash",
-					"salt",
-					"akey",
-					"public_key",
-					"private_key",
-					"security_stamp",
-					"client_kdf_iter",
-				}),
-			},
-		).Create(&user).Error
-		if err != nil {
-			return err
-		}
+	user := keys.user
+	// create if not found
+	conflict := clause.OnConflict{
+		Columns: []clause.Column{{Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"name",
+			"password_hash",
+			"password_iterations",
+			"salt",
+			"akey",
+			"public_key",
+			"private_key",
+			"security_stamp",
+			"client_kdf_type",
+			"client_kdf_iter",
+			"client_kdf_memory",
+			"client_kdf_parallelism",
+		}),
+	}
+	if !overwrite {
+		conflict = clause.OnConflict{Columns: conflict.Columns, DoNothing: true}
+	}
+	res := tx.Clauses(
+		clause.Returning{Columns: []clause.Column{{Name: "uuid"}}},
+		conflict,
+	).Create(&user)
+	if res.Error != nil {
+		return nil, nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, nil, errors.Wrapf(errUserExists, "email %s", user.Email)
+	}
 
-		for orgUUID, role := range org2role {
-			userOrg := model.UsersOrganization{
-				UUID:      uuid.NewString(),
-				UserUUID:  user.UUID,
-				OrgUUID:   orgUUID,
-				Akey:      pkcs.BWPKEncrypt(m.orgSymKeys[orgUUID], pubInf),
-				AccessAll: false,
-				Status:    2,
-				Atype:     role,
-			}
-			if err := tx.Create(&userOrg).Error; err != nil {
-				return err
-			}
+	// keys of user are regenerated, memberships are updated with them
+	for orgUUID, role := range org2role {
+		if _, err := m.upsertMembership(tx, actor, &user, keys.pub, orgUUID, role, nil); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		return nil
-	})
+	if keys.initialPassword == "" {
+		return &user, nil, nil
+	}
+	return &user, &initialPasswordMail{name: user.Name, email: user.Email, password: keys.initialPassword}, nil
 }
@@ -0,0 +1,120 @@
+package mgr
+
+import (
+	"sort"
+
+	"github.com/imtaco/vwmgr/pkg/hibp"
+	"github.com/pkg/errors"
+)
+
+var errNoPwnedList = errors.New("pwned passwords list is not configured")
+
+type exposedPasswordsQuery struct {
+	OrgUUID string `form:"org_uuid" binding:"omitempty,uuid"`
+}
+
+type exposedItem struct {
+	ItemUUID    string `json:"item_uuid"`
+	ItemName    string `json:"item_name"`
+	AccountName string `json:"account_name"`
+	// times the password is seen in breaches
+	ExposureCount int64 `json:"exposure_count"`
+	// set if the item can not be decrypted, so it is not checked
+	Error string `json:"error,omitempty"`
+}
+
+type exposedCollection struct {
+	OrgUUID        string        `json:"org_uuid"`
+	OrgName        string        `json:"org_name"`
+	CollectionUUID string        `json:"collection_uuid"`
+	CollectionName string        `json:"collection_name"`
+	Owners         []string      `json:"owners"`
+	Items          []exposedItem `json:"items"`
+}
+
+// exposedPasswordsReport lists login items by collection whose passwords
+// are in the local pwned passwords list, collections without any are
+// left out. Items failing to decrypt are listed with an error.
+func (m *VMManager) exposedPasswordsReport(orgUUID string) ([]exposedCollection, error) {
+	if m.pwned == nil {
+		return nil, errNoPwnedList
+	}
+
+	logins, err := m.collectionLogins(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := m.collectionOwners(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	items, failed, err := m.decryptCollectionItems(logins)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]string{}
+	for uuid, item := range items {
+		if pw := item.Password(); pw != "" {
+			hashes[uuid] = hibp.Hash(pw)
+		}
+	}
+	list := make([]string, 0, len(hashes))
+	for _, h := range hashes {
+		list = append(list, h)
+	}
+	found, err := m.pwned.Lookup(list)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []exposedCollection{}
+	idx := map[string]int{}
+	for _, l := range logins {
+		var exposed exposedItem
+		if msg, ok := failed[l.ItemUUID]; ok {
+			exposed = exposedItem{ItemUUID: l.ItemUUID, Error: msg}
+		} else if count, ok := found[hashes[l.ItemUUID]]; ok {
+			item := items[l.ItemUUID]
+			exposed = exposedItem{
+				ItemUUID:      item.UUID,
+				ItemName:      item.Name,
+				AccountName:   item.Username(),
+				ExposureCount: count,
+			}
+		} else {
+			continue
+		}
+		i, ok := idx[l.CollectionUUID]
+		if !ok {
+			i = len(results)
+			idx[l.CollectionUUID] = i
+			colOwners := owners[l.CollectionUUID]
+			if colOwners == nil {
+				colOwners = []string{}
+			}
+			results = append(results, exposedCollection{
+				OrgUUID:        l.OrgUUID,
+				OrgName:        l.OrgName,
+				CollectionUUID: l.CollectionUUID,
+				CollectionName: l.CollectionName,
+				Owners:         colOwners,
+				Items:          []exposedItem{},
+			})
+		}
+		results[i].Items = append(results[i].Items, exposed)
+	}
+
+	for _, r := range results {
+		sort.Slice(r.Items, func(i, j int) bool {
+			return r.Items[i].ItemName < r.Items[j].ItemName
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].OrgName != results[j].OrgName {
+			return results[i].OrgName < results[j].OrgName
+		}
+		return results[i].CollectionName < results[j].CollectionName
+	})
+	return results, nil
+}
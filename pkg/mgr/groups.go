@@ -0,0 +1,420 @@
+package mgr
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+type orgGroup struct {
+	OrgUUID   string `uri:"org_uuid" binding:"required,uuid"`
+	GroupUUID string `uri:"group_uuid" binding:"required,uuid"`
+}
+
+type groupInfo struct {
+	Name       string  `json:"name" binding:"required,max=100"`
+	AccessAll  bool    `json:"access_all"`
+	ExternalID *string `json:"external_id" binding:"omitempty,max=300"`
+}
+
+// groupMembersInfo is the full member list, an empty one removes all
+type groupMembersInfo struct {
+	Emails []string `json:"emails" binding:"required,dive,email,max=64"`
+}
+
+type groupCollection struct {
+	UUID string `json:"uuid" binding:"required,uuid"`
+	collectionAccess
+}
+
+// groupCollectionsInfo is the full collection list, an empty one removes all
+type groupCollectionsInfo struct {
+	Collections []groupCollection `json:"collections" binding:"required,dive"`
+}
+
+type groupCollectionDetail struct {
+	GroupUUID      string `json:"-"`
+	CollectionUUID string `json:"collection_uuid"`
+	CollectionName string `json:"collection_name"`
+	collectionAccess
+}
+
+type groupDetail struct {
+	UUID        string                  `json:"uuid"`
+	Name        string                  `json:"name"`
+	AccessAll   bool                    `json:"access_all"`
+	ExternalID  *string                 `json:"external_id"`
+	Members     []string                `json:"members"`
+	Collections []groupCollectionDetail `json:"collections"`
+}
+
+// groupChanges reports differences applied by set operations
+type groupChanges struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated,omitempty"`
+	Removed []string `json:"removed"`
+}
+
+func (m *VMManager) listGroups(orgUUID string) ([]groupDetail, error) {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []model.Group{}
+	if err := m.db.Where("organizations_uuid = ?", orgUUID).Order("name").Find(&groups).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query groups")
+	}
+
+	members := []struct {
+		GroupUUID string
+		Email     string
+	}{}
+	err = m.db.Raw(`
+	SELECT
+		gu.groups_uuid AS group_uuid,
+		u.email
+	FROM
+		groups_users gu
+		INNER JOIN users_organizations uo ON uo.uuid = gu.users_organizations_uuid
+		INNER JOIN users u ON u.uuid = uo.user_uuid
+	WHERE
+		uo.org_uuid = ?
+	ORDER BY
+		u.email
+	`, orgUUID).Scan(&members).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query group members")
+	}
+
+	cols := []groupCollectionDetail{}
+	err = m.db.Raw(`
+	SELECT
+		cg.groups_uuid AS group_uuid,
+		c.uuid AS collection_uuid,
+		c.name AS collection_name,
+		cg.read_only,
+		cg.hide_passwords,
+		cg.manage
+	FROM
+		collections_groups cg
+		INNER JOIN collections c ON c.uuid = cg.collections_uuid
+	WHERE
+		c.org_uuid = ?
+	`, orgUUID).Scan(&cols).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query group collections")
+	}
+
+	results := make([]groupDetail, 0, len(groups))
+	idx := map[string]int{}
+	for _, g := range groups {
+		idx[g.UUID] = len(results)
+		results = append(results, groupDetail{
+			UUID:        g.UUID,
+			Name:        g.Name,
+			AccessAll:   g.AccessAll,
+			ExternalID:  g.ExternalID,
+			Members:     []string{},
+			Collections: []groupCollectionDetail{},
+		})
+	}
+	for _, gm := range members {
+		d := &results[idx[gm.GroupUUID]]
+		d.Members = append(d.Members, gm.Email)
+	}
+	for _, gc := range cols {
+		name, err := pkcs.BWSymDecrypt(orgSymKey, gc.CollectionName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to decrypt name of collection %s", gc.CollectionUUID)
+		}
+		gc.CollectionName = string(name)
+		d := &results[idx[gc.GroupUUID]]
+		d.Collections = append(d.Collections, gc)
+	}
+	for _, d := range results {
+		sort.Slice(d.Collections, func(i, j int) bool {
+			return d.Collections[i].CollectionName < d.Collections[j].CollectionName
+		})
+	}
+	return results, nil
+}
+
+func (m *VMManager) createGroup(orgUUID string, info groupInfo) (string, error) {
+	if _, err := m.orgSymKey(orgUUID); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	g := model.Group{
+		UUID:              uuid.NewString(),
+		OrganizationsUUID: orgUUID,
+		Name:              info.Name,
+		AccessAll:         info.AccessAll,
+		ExternalID:        info.ExternalID,
+		CreationDate:      now,
+		RevisionDate:      now,
+	}
+	if err := m.db.Create(&g).Error; err != nil {
+		return "", err
+	}
+	return g.UUID, nil
+}
+
+// deleteGroup removes the group with its members and collections
+func (m *VMManager) deleteGroup(orgUUID, groupUUID string) ([]stepResult, error) {
+	r := stepRunner{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		r.tx = tx
+		if err := checkOrgGroup(tx, orgUUID, groupUUID); err != nil {
+			return err
+		}
+
+		steps := []struct {
+			name string
+			fn   func(tx *gorm.DB) *gorm.DB
+		}{
+			{"remove_members", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec("DELETE FROM groups_users WHERE groups_uuid = ?", groupUUID)
+			}},
+			{"remove_collections", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec("DELETE FROM collections_groups WHERE groups_uuid = ?", groupUUID)
+			}},
+			{"delete_group", func(tx *gorm.DB) *gorm.DB {
+				return tx.Delete(&model.Group{}, "uuid = ?", groupUUID)
+			}},
+		}
+		for _, s := range steps {
+			if err := r.run(s.name, s.fn); err != nil {
+				return err
+			}
+		}
+		return touchOrgUsers(tx, orgUUID, time.Now().UTC())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.results, nil
+}
+
+// setGroupMembers makes members of group exactly the emails, it is
+// idempotent for directory sync. All emails must be members of org.
+func (m *VMManager) setGroupMembers(orgUUID, groupUUID string, emails []string) (*groupChanges, error) {
+	changes := &groupChanges{Added: []string{}, Removed: []string{}}
+	// emails are matched case-insensitively, as Vaultwarden does on login
+	lowered := make([]string, 0, len(emails))
+	for _, e := range emails {
+		lowered = append(lowered, strings.ToLower(strings.TrimSpace(e)))
+	}
+	emails = lowered
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgGroup(tx, orgUUID, groupUUID); err != nil {
+			return err
+		}
+
+		type member struct {
+			UserOrgUUID string
+			UserUUID    string
+			Email       string
+		}
+		desired := []member{}
+		if len(emails) > 0 {
+			err := tx.Raw(`
+			SELECT
+				uo.uuid AS user_org_uuid,
+				u.uuid AS user_uuid,
+				u.email
+			FROM
+				users_organizations uo
+				INNER JOIN users u ON u.uuid = uo.user_uuid
+			WHERE
+				uo.org_uuid = ? AND LOWER(u.email) IN ? AND uo.status >= 0
+			`, orgUUID, emails).Scan(&desired).Error
+			if err != nil {
+				return errors.Wrap(err, "fail to query org members")
+			}
+		}
+		desiredSet := map[string]member{}
+		for _, d := range desired {
+			desiredSet[strings.ToLower(d.Email)] = d
+		}
+		missing := []string{}
+		for _, e := range emails {
+			if _, ok := desiredSet[e]; !ok {
+				missing = append(missing, e)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return errors.Wrapf(gorm.ErrRecordNotFound, "not members of org %s: %v", orgUUID, missing)
+		}
+
+		current := []member{}
+		err := tx.Raw(`
+		SELECT
+			uo.uuid AS user_org_uuid,
+			u.uuid AS user_uuid,
+			u.email
+		FROM
+			groups_users gu
+			INNER JOIN users_organizations uo ON uo.uuid = gu.users_organizations_uuid
+			INNER JOIN users u ON u.uuid = uo.user_uuid
+		WHERE
+			gu.groups_uuid = ?
+		`, groupUUID).Scan(&current).Error
+		if err != nil {
+			return errors.Wrap(err, "fail to query group members")
+		}
+		currentSet := map[string]member{}
+		for _, c := range current {
+			currentSet[strings.ToLower(c.Email)] = c
+		}
+
+		touched := []string{}
+		for email, d := range desiredSet {
+			if _, ok := currentSet[email]; ok {
+				continue
+			}
+			err := tx.Exec("INSERT INTO groups_users (groups_uuid, users_organizations_uuid) VALUES (?, ?)",
+				groupUUID, d.UserOrgUUID).Error
+			if err != nil {
+				return err
+			}
+			changes.Added = append(changes.Added, email)
+			touched = append(touched, d.UserUUID)
+		}
+		for email, c := range currentSet {
+			if _, ok := desiredSet[email]; ok {
+				continue
+			}
+			err := tx.Exec("DELETE FROM groups_users WHERE groups_uuid = ? AND users_organizations_uuid = ?",
+				groupUUID, c.UserOrgUUID).Error
+			if err != nil {
+				return err
+			}
+			changes.Removed = append(changes.Removed, email)
+			touched = append(touched, c.UserUUID)
+		}
+		if len(touched) == 0 {
+			return nil
+		}
+
+		now := time.Now().UTC()
+		err = tx.Model(&model.Group{}).Where("uuid = ?", groupUUID).Update("revision_date", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&model.User{}).Where("uuid IN ?", touched).Update("updated_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	return changes, nil
+}
+
+// setGroupCollections makes collections of group exactly the given ones
+// with their access flags.
+func (m *VMManager) setGroupCollections(orgUUID, groupUUID string, cols []groupCollection) (*groupChanges, error) {
+	changes := &groupChanges{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkOrgGroup(tx, orgUUID, groupUUID); err != nil {
+			return err
+		}
+		desired := map[string]collectionAccess{}
+		for _, c := range cols {
+			desired[c.UUID] = c.collectionAccess
+		}
+		if len(desired) > 0 {
+			colUUIDs := make([]string, 0, len(desired))
+			for u := range desired {
+				colUUIDs = append(colUUIDs, u)
+			}
+			if err := checkOrgCollections(tx, orgUUID, colUUIDs); err != nil {
+				return err
+			}
+		}
+
+		current := []struct {
+			CollectionUUID string
+			collectionAccess
+		}{}
+		err := tx.Raw(`
+		SELECT
+			collections_uuid AS collection_uuid,
+			read_only,
+			hide_passwords,
+			manage
+		FROM
+			collections_groups
+		WHERE
+			groups_uuid = ?
+		`, groupUUID).Scan(&current).Error
+		if err != nil {
+			return errors.Wrap(err, "fail to query group collections")
+		}
+		currentSet := map[string]collectionAccess{}
+		for _, c := range current {
+			currentSet[c.CollectionUUID] = c.collectionAccess
+		}
+
+		for colUUID, access := range desired {
+			prev, ok := currentSet[colUUID]
+			if ok && prev == access {
+				continue
+			}
+			err := tx.Exec(`
+			INSERT INTO collections_groups (collections_uuid, groups_uuid, read_only, hide_passwords, manage)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (collections_uuid, groups_uuid) DO UPDATE SET
+				read_only = EXCLUDED.read_only,
+				hide_passwords = EXCLUDED.hide_passwords,
+				manage = EXCLUDED.manage
+			`, colUUID, groupUUID, access.ReadOnly, access.HidePasswords, access.Manage).Error
+			if err != nil {
+				return err
+			}
+			if ok {
+				changes.Updated = append(changes.Updated, colUUID)
+			} else {
+				changes.Added = append(changes.Added, colUUID)
+			}
+		}
+		for colUUID := range currentSet {
+			if _, ok := desired[colUUID]; ok {
+				continue
+			}
+			err := tx.Exec("DELETE FROM collections_groups WHERE collections_uuid = ? AND groups_uuid = ?",
+				colUUID, groupUUID).Error
+			if err != nil {
+				return err
+			}
+			changes.Removed = append(changes.Removed, colUUID)
+		}
+		if len(changes.Added)+len(changes.Updated)+len(changes.Removed) == 0 {
+			return nil
+		}
+
+		now := time.Now().UTC()
+		err = tx.Model(&model.Group{}).Where("uuid = ?", groupUUID).Update("revision_date", now).Error
+		if err != nil {
+			return err
+		}
+		return touchOrgUsers(tx, orgUUID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Updated)
+	sort.Strings(changes.Removed)
+	return changes, nil
+}
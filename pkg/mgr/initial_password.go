@@ -0,0 +1,60 @@
+package mgr
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	initialPasswordLength  = 20
+	initialPasswordSubject = "Your Vaultwarden account"
+	initialPasswordBody    = `Hi %s,
+
+A Vaultwarden account %s is created for you, the initial master password is
+
+%s
+
+Please log in and change the master password right away, this mail should be deleted after that.
+`
+)
+
+var (
+	errNoMailer         = errors.New("mailer is not configured to deliver generated passwords")
+	errPasswordRequired = errors.New("either password or generate_password is required")
+	errMailNotSent      = errors.New("user is created but the initial password is not mailed, reset the password to issue a new one")
+)
+
+// initialPasswordMail is a generated password to deliver, it is only sent
+// after the user is committed
+type initialPasswordMail struct {
+	name     string
+	email    string
+	password string
+}
+
+// sendInitialPasswords delivers mails of committed users, nil ones are
+// skipped. It keeps sending after a failure and returns the first one.
+func (m *VMManager) sendInitialPasswords(mails ...*initialPasswordMail) error {
+	var first error
+	for _, p := range mails {
+		if p == nil {
+			continue
+		}
+		if err := m.sendInitialPassword(p); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m *VMManager) sendInitialPassword(p *initialPasswordMail) error {
+	if m.mailer == nil {
+		return errors.Wrapf(errMailNotSent, "email %s: %v", p.email, errNoMailer)
+	}
+	body := fmt.Sprintf(initialPasswordBody, p.name, p.email, p.password)
+	if err := m.mailer.Send(p.email, initialPasswordSubject, body); err != nil {
+		return errors.Wrapf(errMailNotSent, "email %s: %v", p.email, err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package mgr
+
+import (
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+)
+
+var (
+	kdfName2Type = map[string]pkcs.KdfType{
+		"pbkdf2":   pkcs.KdfPBKDF2,
+		"argon2id": pkcs.KdfArgon2id,
+	}
+)
+
+type kdfInfo struct {
+	Type        string `json:"type" binding:"required,oneof=pbkdf2 argon2id"`
+	Iterations  int    `json:"iterations" binding:"omitempty,min=1"`
+	Memory      int    `json:"memory" binding:"omitempty,min=1"`
+	Parallelism int    `json:"parallelism" binding:"omitempty,min=1"`
+}
+
+// params fills unset fields with defaults of the chosen KDF
+func (k *kdfInfo) params() (pkcs.KdfParams, error) {
+	kdf := pkcs.DefaultKdfParams(kdfName2Type[k.Type])
+	if k.Iterations != 0 {
+		kdf.Iterations = k.Iterations
+	}
+	if kdf.Type == pkcs.KdfArgon2id {
+		if k.Memory != 0 {
+			kdf.Memory = k.Memory
+		}
+		if k.Parallelism != 0 {
+			kdf.Parallelism = k.Parallelism
+		}
+	}
+	return kdf, kdf.Validate()
+}
@@ -0,0 +1,202 @@
+package mgr
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	// users with a legacy TOTP secret, or any enabled provider in twofactor,
+	// types out of providers are remember tokens, recovery code and challenges
+	has2FASQL = `(
+		users.totp_secret IS NOT NULL
+		OR EXISTS (
+			SELECT 1 FROM twofactor tf
+			WHERE tf.user_uuid = users.uuid AND tf.enabled = TRUE
+				AND tf.atype IN (0, 1, 2, 3, 4, 6, 7)
+		)
+	)`
+)
+
+var (
+	roleID2Name = map[int32]string{
+		roleOwner:   "owner",
+		roleAdmin:   "admin",
+		roleUser:    "user",
+		roleManager: "manager",
+	}
+	statusName2ID = map[string]int32{
+		"invited":   statusInvited,
+		"accepted":  statusAccepted,
+		"confirmed": statusConfirmed,
+	}
+)
+
+// statusName maps membership status, any negative one is revoked
+func statusName(status int32) string {
+	switch {
+	case status < 0:
+		return "revoked"
+	case status == statusInvited:
+		return "invited"
+	case status == statusAccepted:
+		return "accepted"
+	case status == statusConfirmed:
+		return "confirmed"
+	default:
+		return "unknown"
+	}
+}
+
+type userFilter struct {
+	Email    string `form:"email" binding:"max=64"`
+	OrgUUID  string `form:"org_uuid" binding:"omitempty,uuid"`
+	Role     string `form:"role" binding:"omitempty,oneof=owner admin user manager"`
+	Status   string `form:"status" binding:"omitempty,oneof=invited accepted confirmed revoked"`
+	Enabled  *bool  `form:"enabled"`
+	Has2FA   *bool  `form:"has_2fa"`
+	Page     int    `form:"page" binding:"omitempty,min=1"`
+	PageSize int    `form:"page_size" binding:"omitempty,min=1,max=500"`
+}
+
+type userMembership struct {
+	UserUUID  string `json:"-"`
+	OrgUUID   string `json:"org_uuid"`
+	OrgName   string `json:"org_name"`
+	Role      string `json:"role"`
+	Status    string `json:"status"`
+	AccessAll bool   `json:"access_all"`
+
+	Atype        int32 `json:"-"`
+	MemberStatus int32 `json:"-"`
+}
+
+type userListItem struct {
+	UUID        string           `json:"uuid"`
+	Email       string           `json:"email"`
+	Name        string           `json:"name"`
+	Enabled     bool             `json:"enabled"`
+	Has2FA      bool             `gorm:"column:has_2fa" json:"has_2fa"`
+	CreatedAt   time.Time        `json:"created_at"`
+	Memberships []userMembership `gorm:"-" json:"memberships"`
+}
+
+type userList struct {
+	Total    int64          `json:"total"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"page_size"`
+	Users    []userListItem `json:"users"`
+}
+
+func (m *VMManager) listUsers(f userFilter) (*userList, error) {
+	if f.Page == 0 {
+		f.Page = 1
+	}
+	if f.PageSize == 0 {
+		f.PageSize = 50
+	}
+
+	q := m.db.Table("users")
+	if f.Email != "" {
+		q = q.Where("users.email ILIKE ?", "%"+escapeLike(f.Email)+"%")
+	}
+	if f.Enabled != nil {
+		q = q.Where("users.enabled = ?", *f.Enabled)
+	}
+	if f.Has2FA != nil {
+		if *f.Has2FA {
+			q = q.Where(has2FASQL)
+		} else {
+			q = q.Where("NOT " + has2FASQL)
+		}
+	}
+	// conditions on the same membership
+	if f.OrgUUID != "" || f.Role != "" || f.Status != "" {
+		sub := m.db.Table("users_organizations uo").
+			Select("1").
+			Where("uo.user_uuid = users.uuid")
+		if f.OrgUUID != "" {
+			sub = sub.Where("uo.org_uuid = ?", f.OrgUUID)
+		}
+		if f.Role != "" {
+			sub = sub.Where("uo.atype = ?", roleName2ID[f.Role])
+		}
+		if f.Status == "revoked" {
+			sub = sub.Where("uo.status < 0")
+		} else if f.Status != "" {
+			sub = sub.Where("uo.status = ?", statusName2ID[f.Status])
+		}
+		q = q.Where("EXISTS (?)", sub)
+	}
+	// reused by count and query
+	q = q.Session(&gorm.Session{})
+
+	result := &userList{
+		Page:     f.Page,
+		PageSize: f.PageSize,
+		Users:    []userListItem{},
+	}
+	if err := q.Count(&result.Total).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to count users")
+	}
+
+	err := q.
+		Select("users.uuid, users.email, users.name, users.enabled, users.created_at, " + has2FASQL + " AS has_2fa").
+		Order("users.email").
+		Offset((f.Page - 1) * f.PageSize).
+		Limit(f.PageSize).
+		Scan(&result.Users).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query users")
+	}
+	if len(result.Users) == 0 {
+		return result, nil
+	}
+
+	userUUIDs := make([]string, 0, len(result.Users))
+	for _, u := range result.Users {
+		userUUIDs = append(userUUIDs, u.UUID)
+	}
+
+	memberships := []userMembership{}
+	sql := `
+	SELECT
+		uo.user_uuid,
+		uo.org_uuid,
+		o.name AS org_name,
+		uo.access_all,
+		uo.atype,
+		uo.status AS member_status
+	FROM
+		users_organizations uo
+		INNER JOIN organizations o ON o.uuid = uo.org_uuid
+	WHERE
+		uo.user_uuid IN ?
+	ORDER BY
+		o.name
+	`
+	if err := m.db.Raw(sql, userUUIDs).Scan(&memberships).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query memberships")
+	}
+
+	user2members := map[string][]userMembership{}
+	for _, um := range memberships {
+		um.Role = roleID2Name[um.Atype]
+		um.Status = statusName(um.MemberStatus)
+		user2members[um.UserUUID] = append(user2members[um.UserUUID], um)
+	}
+	for i, u := range result.Users {
+		result.Users[i].Memberships = user2members[u.UUID]
+		if result.Users[i].Memberships == nil {
+			result.Users[i].Memberships = []userMembership{}
+		}
+	}
+	return result, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
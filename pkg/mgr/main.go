@@ -2,45 +2,79 @@ package mgr
 
 import (
 	"errors"
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/imtaco/vwmgr/pkg/hibp"
+	"github.com/imtaco/vwmgr/pkg/logging"
+	"github.com/imtaco/vwmgr/pkg/mailer"
 	"github.com/imtaco/vwmgr/pkg/pkcs"
 	"gorm.io/gorm"
 )
 
 func New(
 	orgSymKeys map[string][]byte,
+	saEmail string,
 	apiKey string,
 	db *gorm.DB,
+	mailer mailer.Sender,
+	pwned *hibp.Store,
 ) *VMManager {
 	return &VMManager{
 		orgSymKeys: orgSymKeys,
+		saEmail:    saEmail,
 		apiKey:     apiKey,
 		db:         db,
+		mailer:     mailer,
+		pwned:      pwned,
 	}
 }
 
 type VMManager struct {
 	orgSymKeys map[string][]byte
-	apiKey     string
-	db         *gorm.DB
+	// service account holding org keys, see common.GetOrgSymKeys
+	saEmail string
+	apiKey  string
+	db      *gorm.DB
+	// delivers generated passwords, nil if not configured
+	mailer mailer.Sender
+	// offline pwned passwords list, nil if not configured
+	pwned *hibp.Store
 }
 
 type orgInfo struct {
 	UUID string `json:"uuid" binding:"required,uuid"`
-	Role string `json:"role" binding:"required,oneof=user custom"`
+	Role string `json:"role" binding:"required,oneof=user custom manager admin owner"`
 }
 type userInfo struct {
-	Email    string    `json:"email" binding:"required,email,max=64"`
-	Name     string    `json:"name" binding:"required,min=2,max=32"`
-	Password string    `json:"password" binding:"required,min=12,max=128"`
-	OrgInfo  []orgInfo `json:"org_info" binding:"required"`
+	Email            string    `json:"email" binding:"required,email,max=64"`
+	Name             string    `json:"name" binding:"required,min=2,max=32"`
+	Password         string    `json:"password" binding:"omitempty,min=12,max=128"`
+	GeneratePassword bool      `json:"generate_password"`
+	OrgInfo          []orgInfo `json:"org_info" binding:"required,dive"`
+	Kdf              *kdfInfo  `json:"kdf"`
+}
+
+// checkPassword requires exactly one of password and generate_password
+func (u *userInfo) checkPassword() error {
+	if u.GeneratePassword == (u.Password != "") {
+		return errPasswordRequired
+	}
+	return nil
 }
 
 type newPwdInfo struct {
-	NewPassword string `json:"new_password" binding:"required,min=12,max=128"`
+	NewPassword string   `json:"new_password" binding:"required,min=12,max=128"`
+	Kdf         *kdfInfo `json:"kdf"`
+}
+
+type upgradeKdfInfo struct {
+	NewPassword string   `json:"new_password" binding:"required,min=12,max=128"`
+	Kdf         *kdfInfo `json:"kdf" binding:"required"`
+}
+
+type orgUUID struct {
+	OrgUUID string `uri:"org_uuid" binding:"required,uuid"`
 }
 
 type userEmail struct {
@@ -49,18 +83,27 @@ type userEmail struct {
 
 var (
 	roleName2ID = map[string]int32{
-		"user":   roleUser,
-		"custom": roleCustom,
+		"user":    roleUser,
+		"manager": roleManager,
+		"admin":   roleAdmin,
+		"owner":   roleOwner,
+		// name of manager in earlier versions, only accepted as input
+		"custom": roleManager,
 	}
 )
 
 func (m *VMManager) Bind(g *gin.Engine) {
-	g.Use(m.validateAPIKey)
+	// secrets are read with scoped tokens instead of API keys
+	m.bindSecrets(g)
+
+	// all other routes are authenticated by API keys, and each of them
+	// must require a scope, see requireScope
+	api := g.Group("", m.validateAPIKey)
 
 	// for health check
-	g.GET("/_healthz", func(c *gin.Context) {})
+	api.GET("/_healthz", requireAuth, func(c *gin.Context) {})
 
-	g.POST("/api/users", func(c *gin.Context) {
+	api.POST("/api/users", requireScope(scopeUsersCreate), func(c *gin.Context) {
 		u := userInfo{}
 
 		if err := c.ShouldBindJSON(&u); err != nil {
@@ -68,13 +111,37 @@ func (m *VMManager) Bind(g *gin.Engine) {
 			return
 		}
 
-		log.Printf("try to register %+v", u)
+		if err := u.checkPassword(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if u.GeneratePassword && m.mailer == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": errNoMailer.Error()})
+			return
+		}
+
+		// never log the request body, it has the password
+		logging.From(c).Info("try to register", "email", u.Email, "generate_password", u.GeneratePassword)
+
+		kdf := pkcs.DefaultKdfParams(pkcs.KdfPBKDF2)
+		if u.Kdf != nil {
+			var err error
+			if kdf, err = u.Kdf.params(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
 
+		caller := callerOf(c)
 		org2role := map[string]int32{}
 		for _, o := range u.OrgInfo {
 			org2role[o.UUID] = roleName2ID[o.Role]
+			if err := checkRoleGrant(caller, org2role[o.UUID]); err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			}
 		}
-		if err := m.createUser(u.Email, u.Name, u.Password, org2role); err != nil {
+		if err := m.createUser(u.Email, u.Name, u.Password, org2role, kdf, caller.Name); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
@@ -82,7 +149,46 @@ func (m *VMManager) Bind(g *gin.Engine) {
 		c.JSON(http.StatusCreated, gin.H{"status": "ok"})
 	})
 
-	g.POST("/api/users/:email/reset", func(c *gin.Context) {
+	api.POST("/api/users/bulk", requireScope(scopeUsersCreate), func(c *gin.Context) {
+		q := bulkQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		format := BulkFormatJSON
+		if c.ContentType() == "text/csv" {
+			format = BulkFormatCSV
+		}
+		users, err := parseBulkUsers(c.Request.Body, format)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to bulk create", "users", len(users), "atomic", q.Atomic)
+
+		results := m.bulkCreateUsers(users, q.Atomic, callerOf(c))
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	})
+
+	api.GET("/api/users", requireScope(scopeUsersRead), func(c *gin.Context) {
+		f := userFilter{}
+		if err := c.ShouldBindQuery(&f); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		users, err := m.listUsers(f)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, users)
+	})
+
+	api.POST("/api/users/:email/reset", requireScope(scopeUsersReset), func(c *gin.Context) {
 		u := userEmail{}
 		if err := c.ShouldBindUri(&u); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -96,9 +202,19 @@ func (m *VMManager) Bind(g *gin.Engine) {
 			return
 		}
 
-		log.Printf("try to reset %s", u.Email)
+		var kdf *pkcs.KdfParams
+		if nu.Kdf != nil {
+			p, err := nu.Kdf.params()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			kdf = &p
+		}
+
+		logging.From(c).Info("try to reset", "email", u.Email)
 
-		if err := m.resetUserPassword(u.Email, nu.NewPassword); err != nil {
+		if err := m.resetUserPassword(u.Email, nu.NewPassword, kdf); err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			} else {
@@ -110,89 +226,899 @@ func (m *VMManager) Bind(g *gin.Engine) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
-	g.GET("/api/orgs/items", func(c *gin.Context) {
-		log.Println("dump org items")
+	api.POST("/api/users/:email/upgrade_kdf", requireScope(scopeUsersReset), func(c *gin.Context) {
+		u := userEmail{}
+		if err := c.ShouldBindUri(&u); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-		items, err := m.listOrgItems()
+		nu := upgradeKdfInfo{}
+		if err := c.ShouldBindJSON(&nu); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		kdf, err := nu.Kdf.params()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		results := make([]orgItemDetail, 0, len(items))
-		for _, d := range items {
-			orgSymKey, ok := m.orgSymKeys[d.OrgUUID]
-			if !ok {
-				c.JSON(http.StatusNotFound, gin.H{"error": "fail to find some org sym key"})
-				return
-			}
+		logging.From(c).Info("try to upgrade kdf", "email", u.Email, "kdf", kdf.String())
 
-			p, err := pkcs.BWSymDecryptMany(orgSymKey, d.CollectionName, d.ItemName)
-			if err != nil {
+		if err := m.upgradeUserKdf(u.Email, nu.NewPassword, kdf); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errKdfNotStronger) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	for path, enabled := range map[string]bool{
+		"/api/users/:email/enable":  true,
+		"/api/users/:email/disable": false,
+	} {
+		api.POST(path, requireScope(scopeUsersOffboard), func(c *gin.Context) {
+			u := userEmail{}
+			if err := c.ShouldBindUri(&u); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			d.CollectionName, d.ItemName = string(p[0]), string(p[1])
 
-			if d.AccountName != "" {
-				accountNameDec, err := pkcs.BWSymDecrypt(orgSymKey, d.AccountName)
-				if err != nil {
+			logging.From(c).Info("try to set enabled", "email", u.Email, "enabled", enabled)
+
+			steps, err := m.setUserEnabled(u.Email, enabled)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				} else {
 					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
 				}
-				d.AccountName = string(accountNameDec)
+				return
 			}
 
-			results = append(results, d)
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "steps": steps})
+		})
+	}
+
+	api.POST("/api/users/:email/offboard", requireScope(scopeUsersOffboard), func(c *gin.Context) {
+		u := userEmail{}
+		if err := c.ShouldBindUri(&u); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
-		c.JSON(http.StatusOK, results)
+		logging.From(c).Info("try to offboard", "email", u.Email)
+
+		steps, err := m.offboardUser(u.Email)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errLastOwner) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "steps": steps})
 	})
 
-	g.GET("/api/users/:email/depart_report", func(c *gin.Context) {
-		u := userEmail{}
-		if err := c.ShouldBindUri(&u); err != nil {
+	api.PUT("/api/users/:email/orgs/:org_uuid", requireScope(scopeUsersCreate), func(c *gin.Context) {
+		uo := userOrg{}
+		if err := c.ShouldBindUri(&uo); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := membershipInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		log.Printf("get depart user report of %s", u.Email)
+		caller := callerOf(c)
+		role := roleName2ID[info.Role]
+		if err := checkRoleGrant(caller, role); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to set membership", "email", uo.Email, "org_uuid", uo.OrgUUID, "role", info.Role)
 
-		items, err := m.userDepartReport(u.Email)
+		created, err := m.setMembership(uo.Email, uo.OrgUUID, role, info.AccessAll, caller)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errElevatedRole) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errLastOwner) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
 			return
 		}
 
-		results := []leaveUserItem{}
-		for _, d := range items {
-			orgSymKey, ok := m.orgSymKeys[d.OrgUUID]
-			if !ok {
-				c.JSON(http.StatusNotFound, gin.H{"error": "fail to find some org sym key"})
-				return
+		if created {
+			c.JSON(http.StatusCreated, gin.H{"status": "ok"})
+		} else {
+			c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		}
+	})
+
+	api.DELETE("/api/users/:email/orgs/:org_uuid", requireScope(scopeUsersOffboard), func(c *gin.Context) {
+		uo := userOrg{}
+		if err := c.ShouldBindUri(&uo); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to remove membership", "email", uo.Email, "org_uuid", uo.OrgUUID)
+
+		steps, err := m.removeMembership(uo.Email, uo.OrgUUID, callerOf(c))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errElevatedRole) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errLastOwner) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
+			return
+		}
 
-			colName, err := pkcs.BWSymDecrypt(orgSymKey, d.CollectionName)
-			if err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "steps": steps})
+	})
+
+	api.POST("/api/sync", requireScope(scopeUsersSync), func(c *gin.Context) {
+		q := syncQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		req := syncRequest{}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to sync", "users", len(req.Users), "orgs", len(req.OrgUUIDs), "apply", q.Apply)
+
+		plan, err := m.syncUsers(req, q.Apply, callerOf(c))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errInvalidSync) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errElevatedRole) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errLastOwner) || errors.Is(err, errUserExists) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
 			}
-			d.CollectionName = string(colName)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"applied": q.Apply, "actions": plan})
+	})
+
+	api.GET("/api/orgs/items", requireScope(scopeItemsRead), func(c *gin.Context) {
+		logging.From(c).Info("dump org items")
+
+		items, err := m.listOrgItems()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		results := make([]orgItemDetail, 0, len(items))
+		for _, d := range items {
+			// a broken item is reported in place, the rest are still listed
+			if err := m.decryptOrgItem(&d); err != nil {
+				logging.From(c).Warn("fail to decrypt org item", "item_uuid", d.ItemUUID, "error", err)
+				d.Error = err.Error()
+			}
 			results = append(results, d)
 		}
 
 		c.JSON(http.StatusOK, results)
 	})
-}
 
-func (m *VMManager) validateAPIKey(c *gin.Context) {
-	apiKey := c.Request.Header.Get("X-API-Key")
-	if apiKey != m.apiKey {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "Authentication failed"})
-		return
-	}
+	api.POST("/api/orgs/:org_uuid/items", requireScope(scopeItemsWrite), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		item := orgItemInfo{}
+		if err := c.ShouldBindJSON(&item); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to create item", "org_uuid", o.OrgUUID)
+
+		itemUUID, err := m.createOrgItem(o.OrgUUID, item)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"uuid": itemUUID})
+	})
+
+	api.POST("/api/orgs/:org_uuid/items/rotate", requireScope(scopeItemsWrite), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := rotateItemInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to rotate item password", "org_uuid", o.OrgUUID)
+
+		itemUUID, err := m.rotateOrgItemPassword(o.OrgUUID, info)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errAmbiguousItem) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errNotLoginItem) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"uuid": itemUUID})
+	})
+
+	api.GET("/api/orgs/:org_uuid/collections", requireScope(scopeCollectionsRead), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		cols, err := m.listCollections(o.OrgUUID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, cols)
+	})
+
+	api.POST("/api/orgs/:org_uuid/collections", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := collectionInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to create collection", "org_uuid", o.OrgUUID)
+
+		colUUID, err := m.createCollection(o.OrgUUID, info)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"uuid": colUUID})
+	})
+
+	api.PUT("/api/orgs/:org_uuid/collections/:collection_uuid", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		oc := orgCollection{}
+		if err := c.ShouldBindUri(&oc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := collectionInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to update collection", "org_uuid", oc.OrgUUID, "collection_uuid", oc.CollectionUUID)
+
+		if err := m.updateCollection(oc.OrgUUID, oc.CollectionUUID, info); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.DELETE("/api/orgs/:org_uuid/collections/:collection_uuid", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		oc := orgCollection{}
+		if err := c.ShouldBindUri(&oc); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to delete collection", "org_uuid", oc.OrgUUID, "collection_uuid", oc.CollectionUUID)
+
+		steps, err := m.deleteCollection(oc.OrgUUID, oc.CollectionUUID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "steps": steps})
+	})
+
+	api.PUT("/api/orgs/:org_uuid/collections/:collection_uuid/users/:email", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		ocu := orgCollectionUser{}
+		if err := c.ShouldBindUri(&ocu); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		access := collectionAccess{}
+		if err := c.ShouldBindJSON(&access); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to assign collection to user", "collection_uuid", ocu.CollectionUUID, "email", ocu.Email)
+
+		if err := m.setCollectionUser(ocu.OrgUUID, ocu.CollectionUUID, ocu.Email, access); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.DELETE("/api/orgs/:org_uuid/collections/:collection_uuid/users/:email", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		ocu := orgCollectionUser{}
+		if err := c.ShouldBindUri(&ocu); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to unassign collection from user", "collection_uuid", ocu.CollectionUUID, "email", ocu.Email)
+
+		if err := m.removeCollectionUser(ocu.OrgUUID, ocu.CollectionUUID, ocu.Email); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.PUT("/api/orgs/:org_uuid/collections/:collection_uuid/groups/:group_uuid", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		ocg := orgCollectionGroup{}
+		if err := c.ShouldBindUri(&ocg); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		access := collectionAccess{}
+		if err := c.ShouldBindJSON(&access); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to assign collection to group", "collection_uuid", ocg.CollectionUUID, "group_uuid", ocg.GroupUUID)
+
+		if err := m.setCollectionGroup(ocg.OrgUUID, ocg.CollectionUUID, ocg.GroupUUID, access); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.DELETE("/api/orgs/:org_uuid/collections/:collection_uuid/groups/:group_uuid", requireScope(scopeCollectionsWrite), func(c *gin.Context) {
+		ocg := orgCollectionGroup{}
+		if err := c.ShouldBindUri(&ocg); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to unassign collection from group", "collection_uuid", ocg.CollectionUUID, "group_uuid", ocg.GroupUUID)
+
+		if err := m.removeCollectionGroup(ocg.OrgUUID, ocg.CollectionUUID, ocg.GroupUUID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.GET("/api/orgs/:org_uuid/groups", requireScope(scopeGroupsRead), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		groups, err := m.listGroups(o.OrgUUID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, groups)
+	})
+
+	api.POST("/api/orgs/:org_uuid/groups", requireScope(scopeGroupsWrite), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := groupInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to create group", "org_uuid", o.OrgUUID, "name", info.Name)
+
+		groupUUID, err := m.createGroup(o.OrgUUID, info)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"uuid": groupUUID})
+	})
+
+	api.DELETE("/api/orgs/:org_uuid/groups/:group_uuid", requireScope(scopeGroupsWrite), func(c *gin.Context) {
+		og := orgGroup{}
+		if err := c.ShouldBindUri(&og); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to delete group", "org_uuid", og.OrgUUID, "group_uuid", og.GroupUUID)
+
+		steps, err := m.deleteGroup(og.OrgUUID, og.GroupUUID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "steps": steps})
+	})
+
+	api.PUT("/api/orgs/:org_uuid/groups/:group_uuid/members", requireScope(scopeGroupsWrite), func(c *gin.Context) {
+		og := orgGroup{}
+		if err := c.ShouldBindUri(&og); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := groupMembersInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to set group members", "group_uuid", og.GroupUUID, "count", len(info.Emails))
+
+		changes, err := m.setGroupMembers(og.OrgUUID, og.GroupUUID, info.Emails)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, changes)
+	})
+
+	api.PUT("/api/orgs/:org_uuid/groups/:group_uuid/collections", requireScope(scopeGroupsWrite), func(c *gin.Context) {
+		og := orgGroup{}
+		if err := c.ShouldBindUri(&og); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := groupCollectionsInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to set group collections", "group_uuid", og.GroupUUID, "count", len(info.Collections))
+
+		changes, err := m.setGroupCollections(og.OrgUUID, og.GroupUUID, info.Collections)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, changes)
+	})
+
+	api.POST("/api/secret_tokens", requireScope(scopeSecretTokensAdmin), func(c *gin.Context) {
+		info := secretTokenInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to issue secret token", "name", info.Name)
+
+		tokUUID, token, err := m.issueSecretToken(info)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, gorm.ErrDuplicatedKey) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"uuid": tokUUID, "token": token})
+	})
+
+	api.GET("/api/secret_tokens", requireScope(scopeSecretTokensAdmin), func(c *gin.Context) {
+		tokens, err := m.listSecretTokens()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, tokens)
+	})
+
+	api.DELETE("/api/secret_tokens/:uuid", requireScope(scopeSecretTokensAdmin), func(c *gin.Context) {
+		t := tokenUUID{}
+		if err := c.ShouldBindUri(&t); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to revoke secret token", "uuid", t.UUID)
+
+		if err := m.revokeSecretToken(t.UUID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.POST("/api/api_keys", requireScope(scopeAPIKeysAdmin), func(c *gin.Context) {
+		info := apiKeyInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to issue api key", "name", info.Name)
+
+		keyUUID, key, err := m.issueAPIKey(info)
+		if err != nil {
+			if errors.Is(err, errInvalidScope) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else if errors.Is(err, gorm.ErrDuplicatedKey) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"uuid": keyUUID, "key": key})
+	})
+
+	api.GET("/api/api_keys", requireScope(scopeAPIKeysAdmin), func(c *gin.Context) {
+		keys, err := m.listAPIKeys()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	})
+
+	api.DELETE("/api/api_keys/:uuid", requireScope(scopeAPIKeysAdmin), func(c *gin.Context) {
+		t := tokenUUID{}
+		if err := c.ShouldBindUri(&t); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to revoke api key", "uuid", t.UUID)
+
+		if err := m.revokeAPIKey(t.UUID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	api.POST("/api/users/:email/depart", requireScope(scopeUsersOffboard), func(c *gin.Context) {
+		u := userEmail{}
+		if err := c.ShouldBindUri(&u); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := departInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to depart", "email", u.Email, "successor", info.Successor)
+
+		result, err := m.departUser(u.Email, info.Successor, callerOf(c).Name)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errInvalidSuccessor) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errLastOwner) || errors.Is(err, errSuccessorNotMember) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	})
+
+	api.GET("/api/users/:email/depart_report", requireScope(scopeReportsRead), func(c *gin.Context) {
+		u := userEmail{}
+		if err := c.ShouldBindUri(&u); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("get depart user report", "email", u.Email)
+
+		report, err := m.userDepartReport(u.Email)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	})
+
+	api.GET("/api/reports/access", requireScope(scopeReportsRead), func(c *gin.Context) {
+		q := accessReportQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if q.By == "" {
+			q.By = accessByUser
+		}
+
+		logging.From(c).Info("get access report", "org_uuid", q.OrgUUID, "by", q.By, "format", q.Format)
+
+		if q.Format == "csv" {
+			bs, err := m.accessReportCSV(q.OrgUUID, q.By)
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+			c.Data(http.StatusOK, "text/csv; charset=utf-8", bs)
+			return
+		}
+
+		var (
+			report interface{}
+			err    error
+		)
+		if q.By == accessByCollection {
+			report, err = m.accessByCollection(q.OrgUUID)
+		} else {
+			report, err = m.accessByUser(q.OrgUUID)
+		}
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	})
+
+	api.GET("/api/reports/password_health", requireScope(scopeReportsRead), func(c *gin.Context) {
+		q := passwordHealthQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("get password health report", "org_uuid", q.OrgUUID)
+
+		report, err := m.passwordHealthReport(q)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	})
+
+	api.GET("/api/reports/exposed_passwords", requireScope(scopeReportsRead), func(c *gin.Context) {
+		q := exposedPasswordsQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("get exposed passwords report", "org_uuid", q.OrgUUID)
+
+		report, err := m.exposedPasswordsReport(q.OrgUUID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errNoPwnedList) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	})
+
+	api.GET("/api/reports/2fa", requireScope(scopeReportsRead), func(c *gin.Context) {
+		q := twoFactorQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("get 2FA report", "org_uuid", q.OrgUUID)
+
+		report, err := m.twoFactorReport(q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	})
+
+	api.POST("/api/orgs/:org_uuid/2fa/enforce", requireScope(scopeUsersOffboard), func(c *gin.Context) {
+		o := orgUUID{}
+		if err := c.ShouldBindUri(&o); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		q := enforce2FAQuery{}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		info := enforce2FAInfo{}
+		if err := c.ShouldBindJSON(&info); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logging.From(c).Info("try to enforce 2FA", "org_uuid", o.OrgUUID, "grace_days", info.GraceDays, "dry_run", q.DryRun)
+
+		results, err := m.enforce2FA(o.OrgUUID, info, q.DryRun, callerOf(c).Name)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"dry_run": q.DryRun, "members": results})
+	})
 }
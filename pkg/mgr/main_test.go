@@ -0,0 +1,120 @@
+package mgr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// sample values of path params
+	testPathParams = map[string]string{
+		"email": "test01@foobar.com",
+	}
+	testUUID = "7ee41f5e-c8b1-4936-84ec-6d8cf5d2d9bd"
+)
+
+func testEngine() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	// no DB, unauthenticated requests must be rejected before any query
+	New(map[string][]byte{}, "sa@foobar.com", "bootstrap-api-key", nil, nil, nil).Bind(g)
+	return g
+}
+
+func testPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if !strings.HasPrefix(p, ":") && !strings.HasPrefix(p, "*") {
+			continue
+		}
+		if v, ok := testPathParams[p[1:]]; ok {
+			parts[i] = v
+		} else {
+			parts[i] = testUUID
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func TestRoutesRequireAuth(t *testing.T) {
+	g := testEngine()
+
+	headers := map[string]map[string]string{
+		"no key":            {},
+		"empty key":         {"X-API-Key": ""},
+		"wrong key":         {"X-API-Key": "bootstrap-api-key-wrong"},
+		"key prefix only":   {"X-API-Key": "bootstrap"},
+		"bearer no prefix":  {"Authorization": "Bearer bootstrap-api-key"},
+		"bootstrap as auth": {"Authorization": "bootstrap-api-key"},
+	}
+
+	routes := g.Routes()
+	if len(routes) == 0 {
+		t.Fatal("no routes bound")
+	}
+
+	for _, r := range routes {
+		for name, hs := range headers {
+			req := httptest.NewRequest(r.Method, testPath(r.Path), strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range hs {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, req)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with %s: expected %d, got %d", r.Method, r.Path, name, http.StatusUnauthorized, w.Code)
+			}
+		}
+	}
+}
+
+func TestRequireScopeWithoutKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	// bound without validateAPIKey by mistake
+	g.GET("/unguarded", requireScope(scopeReportsRead), func(c *gin.Context) {
+		t.Error("handler should not be reached")
+	})
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unguarded", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name   string
+		key    *apiKey
+		status int
+	}{
+		{"bootstrap", bootstrapAPIKey, http.StatusOK},
+		{"matched scope", &apiKey{Scopes: []string{scopeReportsRead}}, http.StatusOK},
+		{"other scope", &apiKey{Scopes: []string{scopeUsersCreate}}, http.StatusForbidden},
+		{"no scope", &apiKey{}, http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		g := gin.New()
+		g.GET("/report", func(c *gin.Context) {
+			c.Set(ctxAPIKey, tc.key)
+		}, requireScope(scopeReportsRead), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/report", nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package mgr
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type membershipInfo struct {
+	Role      string `json:"role" binding:"required,oneof=user custom manager admin owner"`
+	AccessAll bool   `json:"access_all"`
+}
+
+type userOrg struct {
+	Email   string `uri:"email" binding:"required,email,max=64"`
+	OrgUUID string `uri:"org_uuid" binding:"required,uuid"`
+}
+
+// userPublicKey parses users.public_key, which is base64 of SPKI
+func userPublicKey(user *model.User) (*rsa.PublicKey, error) {
+	der, err := pkcs.Base64Decode(user.PublicKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid public key of %s", user.Email)
+	}
+	return pkcs.PublicKeyInfo(der)
+}
+
+// upsertMembership adds or updates the membership of user in org as confirmed,
+// the org key is encrypted again with the public key of user.
+// A nil accessAll keeps the existing value, or false for a new membership.
+func (m *VMManager) upsertMembership(
+	tx *gorm.DB,
+	actor string,
+	user *model.User,
+	pub *rsa.PublicKey,
+	orgUUID string,
+	role int32,
+	accessAll *bool,
+) (bool, error) {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return false, err
+	}
+
+	prev := model.UsersOrganization{}
+	err = tx.Where("user_uuid = ? AND org_uuid = ?", user.UUID, orgUUID).First(&prev).Error
+	created := errors.Is(err, gorm.ErrRecordNotFound)
+	if err != nil && !created {
+		return false, err
+	}
+	if !created && prev.Atype == roleOwner && prev.Status >= 0 && role != roleOwner {
+		if err := ensureNotLastOwner(tx, orgUUID, user.UUID); err != nil {
+			return false, err
+		}
+	}
+
+	uo := model.UsersOrganization{
+		UUID:     uuid.NewString(),
+		UserUUID: user.UUID,
+		OrgUUID:  orgUUID,
+		Akey:     pkcs.BWPKEncrypt(orgSymKey, pub),
+		Status:   statusConfirmed,
+		Atype:    role,
+	}
+	columns := []string{"akey", "status", "atype"}
+	if accessAll != nil {
+		uo.AccessAll = *accessAll
+		columns = append(columns, "access_all")
+	}
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_uuid"}, {Name: "org_uuid"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).Create(&uo).Error
+	if err != nil {
+		return false, err
+	}
+
+	granted := created || prev.Atype != role || prev.Status < 0
+	if isElevatedRole(role) && granted {
+		err := writeAudit(tx, actor, "grant_role", user.Email, map[string]string{
+			"org_uuid": orgUUID,
+			"role":     roleID2Name[role],
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return created, nil
+}
+
+// setMembership adds or updates a single membership of an existing user
+// without touching the password or keys of user. Changing the role of an
+// elevated member needs the elevated scope as granting one does.
+func (m *VMManager) setMembership(email, orgUUID string, role int32, accessAll bool, caller *apiKey) (bool, error) {
+	created := false
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+		pub, err := userPublicKey(user)
+		if err != nil {
+			return err
+		}
+
+		prev := model.UsersOrganization{}
+		err = tx.Where("user_uuid = ? AND org_uuid = ?", user.UUID, orgUUID).First(&prev).Error
+		if err == nil && prev.Atype != role {
+			if err := checkRoleRemoval(caller, prev.Atype); err != nil {
+				return err
+			}
+		} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if created, err = m.upsertMembership(tx, caller.Name, user, pub, orgUUID, role, &accessAll); err != nil {
+			return err
+		}
+		return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+			Update("updated_at", time.Now().UTC()).Error
+	})
+	return created, err
+}
+
+// removeMembership deletes a single membership of user, along with
+// its collection assignments and group memberships. Removing an elevated
+// member needs the elevated scope.
+func (m *VMManager) removeMembership(email, orgUUID string, caller *apiKey) ([]stepResult, error) {
+	r := stepRunner{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		r.tx = tx
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+
+		uo := model.UsersOrganization{}
+		err = tx.Where("user_uuid = ? AND org_uuid = ?", user.UUID, orgUUID).First(&uo).Error
+		if err != nil {
+			return errors.Wrapf(err, "%s is not a member of org %s", email, orgUUID)
+		}
+		if err := checkRoleRemoval(caller, uo.Atype); err != nil {
+			return err
+		}
+		if uo.Atype == roleOwner && uo.Status >= 0 {
+			if err := ensureNotLastOwner(tx, orgUUID, user.UUID); err != nil {
+				return err
+			}
+		}
+
+		steps := []struct {
+			name string
+			fn   func(tx *gorm.DB) *gorm.DB
+		}{
+			{"remove_collections", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec(`
+				DELETE FROM users_collections
+				WHERE user_uuid = ? AND collection_uuid IN (
+					SELECT uuid FROM collections WHERE org_uuid = ?
+				)`, user.UUID, orgUUID)
+			}},
+			{"remove_groups", func(tx *gorm.DB) *gorm.DB {
+				return tx.Exec("DELETE FROM groups_users WHERE users_organizations_uuid = ?", uo.UUID)
+			}},
+			{"delete_membership", func(tx *gorm.DB) *gorm.DB {
+				return tx.Delete(&model.UsersOrganization{}, "uuid = ?", uo.UUID)
+			}},
+			{"touch_user", func(tx *gorm.DB) *gorm.DB {
+				return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+					Update("updated_at", time.Now().UTC())
+			}},
+		}
+		for _, s := range steps {
+			if err := r.run(s.name, s.fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.results, nil
+}
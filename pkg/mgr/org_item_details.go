@@ -3,6 +3,9 @@ package mgr
 import (
 	"time"
 
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/imtaco/vwmgr/pkg/vault"
 	"github.com/pkg/errors"
 )
 
@@ -18,6 +21,49 @@ type orgItemDetail struct {
 	Access         string    `json:"access"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
+	// set if the item can not be decrypted, names are left empty
+	Error string `json:"error,omitempty"`
+
+	// encrypted cipher, decrypted into item name and account name
+	ItemType int32   `json:"-"`
+	ItemData string  `json:"-"`
+	ItemKey  *string `json:"-"`
+}
+
+func (d *orgItemDetail) cipher() *model.Cipher {
+	return &model.Cipher{
+		UUID:  d.ItemUUID,
+		Atype: d.ItemType,
+		Name:  d.ItemName,
+		Data:  d.ItemData,
+		Key:   d.ItemKey,
+	}
+}
+
+// decryptOrgItem decrypts collection name, item name and account name in
+// place, names are cleared on failure
+func (m *VMManager) decryptOrgItem(d *orgItemDetail) error {
+	colName, itemName := d.CollectionName, d.ItemName
+	d.CollectionName, d.ItemName = "", ""
+
+	orgSymKey, err := m.orgSymKey(d.OrgUUID)
+	if err != nil {
+		return err
+	}
+	name, err := pkcs.BWSymDecrypt(orgSymKey, colName)
+	if err != nil {
+		return errors.Wrap(err, "fail to decrypt collection name")
+	}
+	d.CollectionName = string(name)
+
+	c := d.cipher()
+	c.Name = itemName
+	item, err := vault.Decrypt(c, orgSymKey)
+	if err != nil {
+		return err
+	}
+	d.ItemName, d.AccountName = item.Name, item.Username()
+	return nil
 }
 
 func (m *VMManager) listOrgItems() ([]orgItemDetail, error) {
@@ -32,7 +78,9 @@ func (m *VMManager) listOrgItems() ([]orgItemDetail, error) {
 		c.name as collection_name,
 		p.uuid as item_uuid,
 		p.name as item_name,
-		(p.data::json)->>'username' as account_name,
+		p.atype as item_type,
+		p.data as item_data,
+		p.key as item_key,
 		CASE
 			WHEN uce.manage = TRUE THEN 'manage'
 			WHEN uce.read_only = FALSE THEN 'edit'
@@ -41,7 +89,7 @@ func (m *VMManager) listOrgItems() ([]orgItemDetail, error) {
 		p.created_at,
 		p.updated_at
 	FROM
-		users_collections_expands uce
+		users_collections_access uce
 		INNER JOIN collections c ON c.uuid = uce.collection_uuid
 		INNER JOIN organizations o ON o.uuid = c.org_uuid
 		INNER JOIN ciphers_collections cc ON cc.collection_uuid = c.uuid
@@ -0,0 +1,354 @@
+package mgr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/imtaco/vwmgr/pkg/vault"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMinPasswordLength  = 12
+	defaultMinPasswordEntropy = 60
+	defaultMaxPasswordAgeDays = 365
+
+	flagWeak        = "weak"
+	flagReused      = "reused"
+	flagOld         = "old"
+	flagInsecureURI = "insecure_uri"
+	// the item can not be decrypted, nothing else is checked
+	flagUndecryptable = "undecryptable"
+)
+
+type passwordHealthQuery struct {
+	OrgUUID    string  `form:"org_uuid" binding:"omitempty,uuid"`
+	MinLength  int     `form:"min_length" binding:"omitempty,min=1,max=128"`
+	MinEntropy float64 `form:"min_entropy" binding:"omitempty,min=0"`
+	MaxAgeDays int     `form:"max_age_days" binding:"omitempty,min=1"`
+}
+
+func (q *passwordHealthQuery) setDefaults() {
+	if q.MinLength == 0 {
+		q.MinLength = defaultMinPasswordLength
+	}
+	if q.MinEntropy == 0 {
+		q.MinEntropy = defaultMinPasswordEntropy
+	}
+	if q.MaxAgeDays == 0 {
+		q.MaxAgeDays = defaultMaxPasswordAgeDays
+	}
+}
+
+// collectionItem is an item in a collection, items in many collections
+// come in many rows
+type collectionItem struct {
+	OrgUUID         string
+	OrgName         string
+	CollectionUUID  string
+	CollectionName  string
+	ItemUUID        string
+	ItemType        int32
+	ItemName        string
+	ItemData        string
+	ItemKey         *string
+	PasswordHistory *string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (l *collectionItem) cipher() *model.Cipher {
+	return &model.Cipher{
+		UUID:            l.ItemUUID,
+		Atype:           l.ItemType,
+		Name:            l.ItemName,
+		Data:            l.ItemData,
+		Key:             l.ItemKey,
+		PasswordHistory: l.PasswordHistory,
+		CreatedAt:       l.CreatedAt,
+		UpdatedAt:       l.UpdatedAt,
+	}
+}
+
+type passwordHealthItem struct {
+	ItemUUID          string    `json:"item_uuid"`
+	ItemName          string    `json:"item_name"`
+	AccountName       string    `json:"account_name"`
+	Flags             []string  `json:"flags"`
+	Length            int       `json:"length"`
+	Entropy           float64   `json:"entropy"`
+	ReuseID           string    `json:"reuse_id,omitempty"`
+	ReuseCount        int       `json:"reuse_count,omitempty"`
+	PasswordChangedAt time.Time `json:"password_changed_at"`
+	AgeDays           int       `json:"age_days"`
+	InsecureURIs      []string  `json:"insecure_uris,omitempty"`
+	Error             string    `json:"error,omitempty"`
+
+	// keyed hash of password, only to find reuse
+	digest string
+}
+
+type passwordHealthCollection struct {
+	OrgUUID        string               `json:"org_uuid"`
+	OrgName        string               `json:"org_name"`
+	CollectionUUID string               `json:"collection_uuid"`
+	CollectionName string               `json:"collection_name"`
+	Owners         []string             `json:"owners"`
+	CheckedCount   int                  `json:"checked_count"`
+	Items          []passwordHealthItem `json:"items"`
+}
+
+// passwordChangedAt is the latest of password revision date and
+// password history, or revision date of the item if neither is kept
+func passwordChangedAt(item *vault.Cipher) time.Time {
+	var t time.Time
+	if item.Login.PasswordRevisionDate != nil {
+		t = *item.Login.PasswordRevisionDate
+	}
+	for _, h := range item.PasswordHistory {
+		if h.LastUsedDate.After(t) {
+			t = h.LastUsedDate
+		}
+	}
+	if t.IsZero() {
+		t = item.UpdatedAt
+	}
+	return t
+}
+
+func checkPasswordHealth(item *vault.Cipher, q passwordHealthQuery, hashKey []byte, now time.Time) passwordHealthItem {
+	pw := item.Password()
+	h := passwordHealthItem{
+		ItemUUID:    item.UUID,
+		ItemName:    item.Name,
+		AccountName: item.Username(),
+		Flags:       []string{},
+		Length:      len([]rune(pw)),
+		Entropy:     math.Round(pkcs.PasswordEntropy(pw)*10) / 10,
+	}
+
+	if pw != "" {
+		if h.Length < q.MinLength || h.Entropy < q.MinEntropy {
+			h.Flags = append(h.Flags, flagWeak)
+		}
+		h.digest = hex.EncodeToString(pkcs.HMACSha256(hashKey, []byte(pw)))
+
+		h.PasswordChangedAt = passwordChangedAt(item)
+		h.AgeDays = int(now.Sub(h.PasswordChangedAt).Hours() / 24)
+		if h.AgeDays > q.MaxAgeDays {
+			h.Flags = append(h.Flags, flagOld)
+		}
+	}
+
+	for _, u := range item.Login.Uris {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(u.URI)), "http://") {
+			h.InsecureURIs = append(h.InsecureURIs, u.URI)
+		}
+	}
+	if len(h.InsecureURIs) > 0 {
+		h.Flags = append(h.Flags, flagInsecureURI)
+	}
+	return h
+}
+
+// collectionOwners lists confirmed members who can manage collections,
+// including owners and admins
+func (m *VMManager) collectionOwners(orgUUID string) (map[string][]string, error) {
+	rows := []struct {
+		CollectionUUID string
+		Email          string
+	}{}
+	err := m.db.Raw(`
+	SELECT
+		uce.collection_uuid,
+		u.email
+	FROM
+		users_collections_access uce
+		INNER JOIN collections c ON c.uuid = uce.collection_uuid
+		INNER JOIN users u ON u.uuid = uce.user_uuid
+	WHERE
+		uce.manage = TRUE AND uce.user_org_status = ? AND (? = '' OR c.org_uuid = ?)
+	ORDER BY
+		u.email
+	`, statusConfirmed, orgUUID, orgUUID).Scan(&rows).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query collection owners")
+	}
+	owners := map[string][]string{}
+	for _, r := range rows {
+		owners[r.CollectionUUID] = append(owners[r.CollectionUUID], r.Email)
+	}
+	return owners, nil
+}
+
+// collectionLogins lists login items in collections of all orgs, or the
+// given one
+func (m *VMManager) collectionLogins(orgUUID string) ([]collectionItem, error) {
+	logins := []collectionItem{}
+	err := m.db.Raw(`
+	SELECT
+		c.org_uuid,
+		o.name AS org_name,
+		c.uuid AS collection_uuid,
+		c.name AS collection_name,
+		p.uuid AS item_uuid,
+		p.atype AS item_type,
+		p.name AS item_name,
+		p.data AS item_data,
+		p.key AS item_key,
+		p.password_history,
+		p.created_at,
+		p.updated_at
+	FROM
+		collections c
+		INNER JOIN organizations o ON o.uuid = c.org_uuid
+		INNER JOIN ciphers_collections cc ON cc.collection_uuid = c.uuid
+		INNER JOIN ciphers p ON p.uuid = cc.cipher_uuid
+	WHERE
+		p.deleted_at IS NULL AND p.atype = ? AND (? = '' OR c.org_uuid = ?)
+	`, vault.TypeLogin, orgUUID, orgUUID).Scan(&logins).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query login items")
+	}
+	return logins, nil
+}
+
+// decryptCollectionItems decrypts items once by item, collection names
+// are decrypted in place. Items failing to decrypt are returned with their
+// errors instead of failing all, so one corrupt item blocks nothing.
+func (m *VMManager) decryptCollectionItems(rows []collectionItem) (map[string]*vault.Cipher, map[string]string, error) {
+	items := map[string]*vault.Cipher{}
+	failed := map[string]string{}
+	colNames := map[string]string{}
+	for i := range rows {
+		l := &rows[i]
+		orgSymKey, err := m.orgSymKey(l.OrgUUID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if name, ok := colNames[l.CollectionUUID]; ok {
+			l.CollectionName = name
+		} else {
+			name, err := pkcs.BWSymDecrypt(orgSymKey, l.CollectionName)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "fail to decrypt name of collection %s", l.CollectionUUID)
+			}
+			l.CollectionName = string(name)
+			colNames[l.CollectionUUID] = l.CollectionName
+		}
+
+		if _, ok := items[l.ItemUUID]; ok {
+			continue
+		}
+		if _, ok := failed[l.ItemUUID]; ok {
+			continue
+		}
+		item, err := vault.Decrypt(l.cipher(), orgSymKey)
+		if err != nil {
+			slog.Warn("fail to decrypt collection item", "item_uuid", l.ItemUUID, "error", err)
+			failed[l.ItemUUID] = err.Error()
+			continue
+		}
+		items[l.ItemUUID] = item
+	}
+	return items, failed, nil
+}
+
+// passwordHealthReport lists flagged login items by collection. Reuse is
+// found by HMAC of passwords with a random key of each run, so reuse ids
+// can not be linked across runs nor guessed back to passwords.
+func (m *VMManager) passwordHealthReport(q passwordHealthQuery) ([]passwordHealthCollection, error) {
+	q.setDefaults()
+
+	logins, err := m.collectionLogins(q.OrgUUID)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := m.collectionOwners(q.OrgUUID)
+	if err != nil {
+		return nil, err
+	}
+	items, failed, err := m.decryptCollectionItems(logins)
+	if err != nil {
+		return nil, err
+	}
+
+	hashKey := make([]byte, 32)
+	if _, err := rand.Read(hashKey); err != nil {
+		return nil, errors.Wrap(err, "fail to generate hash key")
+	}
+
+	now := time.Now().UTC()
+	checked := map[string]passwordHealthItem{}
+	reuse := map[string]int{}
+	for uuid, item := range items {
+		h := checkPasswordHealth(item, q, hashKey, now)
+		checked[uuid] = h
+		if h.digest != "" {
+			reuse[h.digest]++
+		}
+	}
+	for uuid, msg := range failed {
+		checked[uuid] = passwordHealthItem{
+			ItemUUID: uuid,
+			Flags:    []string{flagUndecryptable},
+			Error:    msg,
+		}
+	}
+	for uuid, h := range checked {
+		if h.digest != "" && reuse[h.digest] > 1 {
+			h.Flags = append(h.Flags, flagReused)
+			h.ReuseID = h.digest[:12]
+			h.ReuseCount = reuse[h.digest]
+			checked[uuid] = h
+		}
+	}
+
+	results := []passwordHealthCollection{}
+	idx := map[string]int{}
+	for _, l := range logins {
+		i, ok := idx[l.CollectionUUID]
+		if !ok {
+			i = len(results)
+			idx[l.CollectionUUID] = i
+			colOwners := owners[l.CollectionUUID]
+			if colOwners == nil {
+				colOwners = []string{}
+			}
+			results = append(results, passwordHealthCollection{
+				OrgUUID:        l.OrgUUID,
+				OrgName:        l.OrgName,
+				CollectionUUID: l.CollectionUUID,
+				CollectionName: l.CollectionName,
+				Owners:         colOwners,
+				Items:          []passwordHealthItem{},
+			})
+		}
+		r := &results[i]
+		r.CheckedCount++
+		if h := checked[l.ItemUUID]; len(h.Flags) > 0 {
+			r.Items = append(r.Items, h)
+		}
+	}
+
+	for _, r := range results {
+		sort.Slice(r.Items, func(i, j int) bool {
+			return r.Items[i].ItemName < r.Items[j].ItemName
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].OrgName != results[j].OrgName {
+			return results[i].OrgName < results[j].OrgName
+		}
+		return results[i].CollectionName < results[j].CollectionName
+	})
+	return results, nil
+}
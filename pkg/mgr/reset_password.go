@@ -5,26 +5,69 @@ import (
 	"crypto/x509"
 
 	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/common"
 	"github.com/imtaco/vwmgr/pkg/model"
 	"github.com/imtaco/vwmgr/pkg/pkcs"
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
+var (
+	errKdfNotStronger = errors.New("new KDF settings must be stronger than current ones")
+)
+
+// upgradeUserKdf resets password of user with a stronger KDF work factor
+func (m *VMManager) upgradeUserKdf(
+	email string,
+	newMasterPassword string,
+	kdf pkcs.KdfParams,
+) error {
+	user := model.User{}
+	if err := m.db.Where("email = ?", email).First(&user).Error; err != nil {
+		return err
+	}
+
+	current := common.UserKdfParams(&user)
+	if !kdf.StrongerThan(current) {
+		return errors.Wrapf(errKdfNotStronger, "current %s, new %s", current, kdf)
+	}
+	return m.resetUserPassword(email, newMasterPassword, &kdf)
+}
+
 func (m *VMManager) resetUserPassword(
 	email string,
 	newMasterPassword string,
+	kdf *pkcs.KdfParams,
 ) error {
 	// simple validation
 	if email == "" {
 		return errors.New("email is required")
 	}
 
-	userMasterKey := pkcs.DeriveMasterKey(email, newMasterPassword)
+	user := model.User{}
+	if err := m.db.Where("email = ?", email).First(&user).Error; err != nil {
+		return err
+	}
+
+	// keep the KDF of user if not specified
+	if kdf == nil {
+		userKdf := common.UserKdfParams(&user)
+		kdf = &userKdf
+	}
+
+	userMasterKey, err := pkcs.DeriveMasterKey(email, newMasterPassword, *kdf)
+	if err != nil {
+		return errors.Wrap(err, "fail to derive master key")
+	}
 	passwordHash := pkcs.DerivePasswordHash(userMasterKey, newMasterPassword)
 
 	salt := pkcs.RandBytes(64)
-	hashPwdHash := pkcs.HashPasswordHash(passwordHash, salt)
+	// keep the server side iterations of user
+	pwdIterations := int(user.PasswordIterations)
+	if pwdIterations <= 0 {
+		pwdIterations = pkcs.DefaultPasswordIterations
+	}
+	hashPwdHash := pkcs.HashPasswordHash(passwordHash, salt, pwdIterations)
 
 	symKey := pkcs.RandBytes(64)
 	userAkey := pkcs.BWSymEncrypt(userMasterKey, symKey)
@@ -36,11 +79,6 @@ func (m *VMManager) resetUserPassword(
 		panic(err)
 	}
 
-	user := model.User{}
-	if err := m.db.Where("email = ?", email).First(&user).Error; err != nil {
-		return err
-	}
-
 	userOrgs := []model.UsersOrganization{}
 	if err := m.db.Where("user_uuid = ?", user.UUID).Find(&userOrgs).Error; err != nil {
 		// not found or real error
@@ -64,15 +102,16 @@ func (m *VMManager) resetUserPassword(
 		•	Other actions that impact the integrity of the user session
 	*/
 	return m.db.Transaction(func(tx *gorm.DB) error {
+		updates := common.KdfColumns(*kdf)
+		updates["password_hash"] = hashPwdHash
+		updates["salt"] = salt
+		updates["akey"] = userAkey
+		updates["public_key"] = pkcs.Base64Encode(publicKey)
+		updates["private_key"] = pkcs.BWSymEncrypt(symKey, privateKey)
+		updates["security_stamp"] = uuid.NewString()
+
 		err := tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
-			Updates(map[string]interface{}{
-				"password_hash":  hashPwdHash,
-				"salt":           salt,
-				"akey":           userAkey,
-				"public_key":     pkcs.Base64Encode(publicKey),
-				"private_key":    pkcs.BWSymEncrypt(symKey, privateKey),
-				"security_stamp": uuid.NewString(),
-			}).Error
+			Updates(updates).Error
 		if err != nil {
 			return err
 		}
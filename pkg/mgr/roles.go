@@ -0,0 +1,52 @@
+package mgr
+
+import (
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var (
+	errElevatedRole = errors.New("elevated scope is required to grant the role")
+	errLastOwner    = errors.New("the last owner of org can not be demoted or removed")
+)
+
+// isElevatedRole reports roles able to manage the org or its collections
+func isElevatedRole(role int32) bool {
+	return role == roleOwner || role == roleAdmin || role == roleManager
+}
+
+// checkRoleGrant rejects callers granting elevated roles without the scope
+func checkRoleGrant(caller *apiKey, roles ...int32) error {
+	for _, r := range roles {
+		if isElevatedRole(r) && !caller.has(scopeUsersElevate) {
+			return errors.Wrapf(errElevatedRole, "role %s", roleID2Name[r])
+		}
+	}
+	return nil
+}
+
+// checkRoleRemoval rejects callers demoting or removing members of
+// elevated roles without the scope
+func checkRoleRemoval(caller *apiKey, from int32) error {
+	if isElevatedRole(from) && !caller.has(scopeUsersElevate) {
+		return errors.Wrapf(errElevatedRole, "existing role %s", roleID2Name[from])
+	}
+	return nil
+}
+
+// ensureNotLastOwner fails if the user is the last confirmed owner of org
+func ensureNotLastOwner(tx *gorm.DB, orgUUID, userUUID string) error {
+	var count int64
+	err := tx.Model(&model.UsersOrganization{}).
+		Where("org_uuid = ? AND atype = ? AND status = ? AND user_uuid != ?",
+			orgUUID, roleOwner, statusConfirmed, userUUID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.Wrapf(errLastOwner, "org %s", orgUUID)
+	}
+	return nil
+}
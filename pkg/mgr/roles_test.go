@@ -0,0 +1,39 @@
+package mgr
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckSyncGrants(t *testing.T) {
+	plain := &apiKey{Name: "plain", Scopes: []string{scopeUsersCreate}}
+	elevated := &apiKey{Name: "elevated", Scopes: []string{scopeUsersCreate, scopeUsersElevate}}
+
+	tests := []struct {
+		name   string
+		action syncAction
+		denied bool
+	}{
+		{"create user membership", syncAction{Action: actCreateMembership, Role: "user"}, false},
+		{"create admin membership", syncAction{Action: actCreateMembership, Role: "admin"}, true},
+		{"keep owner", syncAction{Action: actUpdateMembership, Role: "owner", From: "owner"}, false},
+		{"promote to manager", syncAction{Action: actUpdateMembership, Role: "manager", From: "user"}, true},
+		{"demote admin", syncAction{Action: actUpdateMembership, Role: "user", From: "admin"}, true},
+		{"restore revoked user", syncAction{Action: actUpdateMembership, Role: "user", From: "revoked"}, false},
+		{"revoke user", syncAction{Action: actRevokeMembership, From: "user"}, false},
+		{"revoke owner", syncAction{Action: actRevokeMembership, From: "owner"}, true},
+		{"add group", syncAction{Action: actAddGroup}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSyncGrants(plain, []syncAction{tt.action})
+			if tt.denied != errors.Is(err, errElevatedRole) {
+				t.Fatalf("err = %v, want denied %v", err, tt.denied)
+			}
+			if err := checkSyncGrants(elevated, []syncAction{tt.action}); err != nil {
+				t.Fatalf("elevated: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package mgr
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	secretTokenPrefix = "vws_"
+)
+
+type secretTokenInfo struct {
+	Name            string   `json:"name" binding:"required,min=2,max=64"`
+	CollectionUUIDs []string `json:"collection_uuids" binding:"required,min=1,dive,uuid"`
+	ExpiresInDays   int      `json:"expires_in_days" binding:"omitempty,min=1,max=3650"`
+}
+
+type secretTokenDetail struct {
+	model.MgrSecretToken
+	CollectionUUIDs []string `json:"collection_uuids"`
+}
+
+type tokenUUID struct {
+	UUID string `uri:"uuid" binding:"required,uuid"`
+}
+
+// newToken returns a random token in plaintext and its hash to store
+func newToken(prefix string) (string, string) {
+	token := prefix + base64.RawURLEncoding.EncodeToString(pkcs.RandBytes(32))
+	return token, hashToken(token)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueSecretToken creates a token to read secrets of given collections,
+// the plaintext token is only returned here.
+func (m *VMManager) issueSecretToken(info secretTokenInfo) (string, string, error) {
+	token, tokenHash := newToken(secretTokenPrefix)
+	t := model.MgrSecretToken{
+		UUID:      uuid.NewString(),
+		Name:      info.Name,
+		TokenHash: tokenHash,
+		CreatedAt: time.Now().UTC(),
+	}
+	if info.ExpiresInDays > 0 {
+		expiresAt := t.CreatedAt.AddDate(0, 0, info.ExpiresInDays)
+		t.ExpiresAt = &expiresAt
+	}
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		cols := []model.Collection{}
+		if err := tx.Where("uuid IN ?", info.CollectionUUIDs).Find(&cols).Error; err != nil {
+			return err
+		}
+		found := map[string]bool{}
+		for _, c := range cols {
+			// secrets can be read only with the org key
+			if _, ok := m.orgSymKeys[c.OrgUUID]; ok {
+				found[c.UUID] = true
+			}
+		}
+		for _, colUUID := range info.CollectionUUIDs {
+			if !found[colUUID] {
+				return errors.Wrapf(gorm.ErrRecordNotFound, "collection %s is not found in managed orgs", colUUID)
+			}
+		}
+
+		if err := tx.Create(&t).Error; err != nil {
+			return err
+		}
+		for colUUID := range found {
+			tc := model.MgrSecretTokenCollection{
+				TokenUUID:      t.UUID,
+				CollectionUUID: colUUID,
+			}
+			if err := tx.Create(&tc).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return t.UUID, token, nil
+}
+
+func (m *VMManager) revokeSecretToken(tokUUID string) error {
+	res := m.db.Model(&model.MgrSecretToken{}).
+		Where("uuid = ? AND revoked_at IS NULL", tokUUID).
+		Update("revoked_at", time.Now().UTC())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.Wrapf(gorm.ErrRecordNotFound, "no active token %s", tokUUID)
+	}
+	return nil
+}
+
+func (m *VMManager) listSecretTokens() ([]secretTokenDetail, error) {
+	tokens := []model.MgrSecretToken{}
+	if err := m.db.Order("created_at").Find(&tokens).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query tokens")
+	}
+	tokCols := []model.MgrSecretTokenCollection{}
+	if err := m.db.Order("collection_uuid").Find(&tokCols).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query token collections")
+	}
+
+	tok2cols := map[string][]string{}
+	for _, tc := range tokCols {
+		tok2cols[tc.TokenUUID] = append(tok2cols[tc.TokenUUID], tc.CollectionUUID)
+	}
+
+	results := make([]secretTokenDetail, 0, len(tokens))
+	for _, t := range tokens {
+		results = append(results, secretTokenDetail{
+			MgrSecretToken:  t,
+			CollectionUUIDs: tok2cols[t.UUID],
+		})
+	}
+	return results, nil
+}
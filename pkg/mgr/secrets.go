@@ -0,0 +1,250 @@
+package mgr
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/logging"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/imtaco/vwmgr/pkg/vault"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	ctxSecretToken = "secret_token"
+)
+
+var (
+	errUnknownField = errors.New("unknown field")
+)
+
+type secretPath struct {
+	Collection string `uri:"collection" binding:"required,max=1000"`
+	Item       string `uri:"item" binding:"required,max=1000"`
+	Field      string `uri:"field" binding:"required,max=256"`
+}
+
+type secretToken struct {
+	model.MgrSecretToken
+	// collection uuid -> org uuid
+	collections map[string]string
+}
+
+// bindSecrets binds the read path of secrets, which is authorized by
+// scoped secret tokens instead of the API key
+func (m *VMManager) bindSecrets(g *gin.Engine) {
+	secrets := g.Group("/api/secrets", m.validateSecretToken)
+
+	secrets.GET("/:collection/:item/:field", func(c *gin.Context) {
+		p := secretPath{}
+		if err := c.ShouldBindUri(&p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tok := c.MustGet(ctxSecretToken).(*secretToken)
+
+		cipherUUID, value, err := m.readSecret(tok, p)
+
+		status := http.StatusOK
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, errUnknownField) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, errAmbiguousItem) {
+				status = http.StatusConflict
+			} else {
+				status = http.StatusInternalServerError
+			}
+		}
+
+		// never serve a secret without an access log
+		if logErr := m.logSecretAccess(c, tok, p, cipherUUID, status); logErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": logErr.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		if c.GetHeader("Accept") == "text/plain" {
+			c.String(http.StatusOK, value)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"item_uuid": cipherUUID,
+			"field":     p.Field,
+			"value":     value,
+		})
+	})
+}
+
+func (m *VMManager) validateSecretToken(c *gin.Context) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || !strings.HasPrefix(token, secretTokenPrefix) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Authentication failed"})
+		return
+	}
+
+	tok := secretToken{collections: map[string]string{}}
+	err := m.db.
+		Where("token_hash = ? AND revoked_at IS NULL", hashToken(token)).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now().UTC()).
+		First(&tok.MgrSecretToken).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Authentication failed"})
+		} else {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	cols := []model.Collection{}
+	err = m.db.
+		Joins("INNER JOIN mgr_secret_token_collections tc ON tc.collection_uuid = collections.uuid").
+		Where("tc.token_uuid = ?", tok.UUID).
+		Find(&cols).Error
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, col := range cols {
+		tok.collections[col.UUID] = col.OrgUUID
+	}
+
+	c.Set(ctxSecretToken, &tok)
+	logging.SetCaller(c, "secret_token:"+tok.Name)
+}
+
+// readSecret returns uuid of the item and value of the field.
+// Collections out of the token scope are reported as not found.
+func (m *VMManager) readSecret(tok *secretToken, p secretPath) (string, string, error) {
+	colUUID, orgUUID, err := m.resolveTokenCollection(tok, p.Collection)
+	if err != nil {
+		return "", "", err
+	}
+	orgSymKey, ok := m.orgSymKeys[orgUUID]
+	if !ok {
+		return "", "", errors.Wrapf(gorm.ErrRecordNotFound, "fail to found org symmetric key of %s", orgUUID)
+	}
+
+	itemUUID := p.Item
+	if uuid.Validate(itemUUID) != nil {
+		if itemUUID, err = findOrgItemByName(m.db, orgSymKey, orgUUID, colUUID, p.Item); err != nil {
+			return "", "", err
+		}
+	}
+
+	cipher := model.Cipher{}
+	err = m.db.
+		Joins("INNER JOIN ciphers_collections cc ON cc.cipher_uuid = ciphers.uuid").
+		Where("ciphers.uuid = ? AND cc.collection_uuid = ? AND ciphers.deleted_at IS NULL", itemUUID, colUUID).
+		First(&cipher).Error
+	if err != nil {
+		return "", "", errors.Wrapf(err, "fail to find item %s", p.Item)
+	}
+
+	v, err := vault.Decrypt(&cipher, orgSymKey)
+	if err != nil {
+		return cipher.UUID, "", err
+	}
+	value, err := cipherField(v, p.Field)
+	return cipher.UUID, value, err
+}
+
+func (m *VMManager) resolveTokenCollection(tok *secretToken, collection string) (string, string, error) {
+	if orgUUID, ok := tok.collections[collection]; ok {
+		return collection, orgUUID, nil
+	}
+
+	// match by decrypted name, only within the token scope
+	colUUIDs := []string{}
+	for colUUID := range tok.collections {
+		colUUIDs = append(colUUIDs, colUUID)
+	}
+	cols := []model.Collection{}
+	if err := m.db.Where("uuid IN ?", colUUIDs).Find(&cols).Error; err != nil {
+		return "", "", err
+	}
+	for _, col := range cols {
+		orgSymKey, ok := m.orgSymKeys[col.OrgUUID]
+		if !ok {
+			continue
+		}
+		name, err := pkcs.BWSymDecrypt(orgSymKey, col.Name)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "fail to decrypt name of collection %s", col.UUID)
+		}
+		if string(name) == collection {
+			return col.UUID, col.OrgUUID, nil
+		}
+	}
+	return "", "", errors.Wrapf(gorm.ErrRecordNotFound, "collection %s is not found", collection)
+}
+
+// cipherField returns a well known field, or a custom field by its name
+func cipherField(v *vault.Cipher, field string) (string, error) {
+	switch field {
+	case "name":
+		return v.Name, nil
+	case "notes":
+		return v.Notes, nil
+	}
+	if v.Login != nil {
+		switch field {
+		case "username":
+			return v.Login.Username, nil
+		case "password":
+			return v.Login.Password, nil
+		case "totp":
+			return v.Login.Totp, nil
+		case "uri":
+			if len(v.Login.Uris) > 0 {
+				return v.Login.Uris[0].URI, nil
+			}
+			return "", nil
+		}
+	}
+	for _, f := range v.Fields {
+		if f.Name == field {
+			return f.Value, nil
+		}
+	}
+	return "", errors.Wrapf(errUnknownField, "no field %s in item %s", field, v.UUID)
+}
+
+func (m *VMManager) logSecretAccess(
+	c *gin.Context,
+	tok *secretToken,
+	p secretPath,
+	cipherUUID string,
+	status int,
+) error {
+	entry := model.MgrSecretAccessLog{
+		CreatedAt:  time.Now().UTC(),
+		TokenUUID:  tok.UUID,
+		TokenName:  tok.Name,
+		ClientIP:   c.ClientIP(),
+		Collection: p.Collection,
+		Item:       p.Item,
+		Field:      p.Field,
+		Status:     int32(status),
+	}
+	if cipherUUID != "" {
+		entry.CipherUUID = &cipherUUID
+	}
+
+	logging.From(c).Info("read secret",
+		"collection", p.Collection,
+		"item", p.Item,
+		"field", p.Field,
+		"token_name", tok.Name,
+		"status", status,
+	)
+	return m.db.Create(&entry).Error
+}
@@ -0,0 +1,553 @@
+package mgr
+
+import (
+	"crypto/rsa"
+	"sort"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var errInvalidSync = errors.New("invalid desired state")
+
+// actions of sync plan, listed in the order to apply
+const (
+	actCreateUser       = "create_user"
+	actCreateMembership = "create_membership"
+	actUpdateMembership = "update_membership"
+	actAddGroup         = "add_group"
+	actAddCollection    = "add_collection"
+	actUpdateCollection = "update_collection"
+	actRemoveCollection = "remove_collection"
+	actRemoveGroup      = "remove_group"
+	actRevokeMembership = "revoke_membership"
+)
+
+var syncActionRank = map[string]int{
+	actCreateUser:       0,
+	actCreateMembership: 1,
+	actUpdateMembership: 2,
+	actAddGroup:         3,
+	actAddCollection:    4,
+	actUpdateCollection: 5,
+	actRemoveCollection: 6,
+	actRemoveGroup:      7,
+	actRevokeMembership: 8,
+}
+
+type syncCollection struct {
+	UUID     string `json:"uuid" binding:"required,uuid"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+type syncMembership struct {
+	UUID        string           `json:"uuid" binding:"required,uuid"`
+	Role        string           `json:"role" binding:"required,oneof=user custom manager admin owner"`
+	AccessAll   bool             `json:"access_all"`
+	Groups      []string         `json:"groups" binding:"dive,uuid"`
+	Collections []syncCollection `json:"collections" binding:"dive"`
+}
+
+type syncUser struct {
+	Email string `json:"email" binding:"required,email,max=64"`
+	Name  string `json:"name" binding:"required,min=2,max=32"`
+	// only used to create the user, never reset for existing ones,
+	// generated and delivered by mail if empty
+	Password string           `json:"password" binding:"omitempty,min=12,max=128"`
+	Orgs     []syncMembership `json:"orgs" binding:"dive"`
+}
+
+// syncRequest is the full desired state of managed orgs, members of them
+// not listed in users are revoked.
+type syncRequest struct {
+	OrgUUIDs []string   `json:"org_uuids" binding:"required,min=1,dive,uuid"`
+	Users    []syncUser `json:"users" binding:"dive"`
+}
+
+type syncQuery struct {
+	Apply bool `form:"apply"`
+}
+
+type syncAction struct {
+	Action  string `json:"action"`
+	Email   string `json:"email"`
+	OrgUUID string `json:"org_uuid,omitempty"`
+	// group or collection UUID
+	Target    string `json:"target,omitempty"`
+	Role      string `json:"role,omitempty"`
+	From      string `json:"from,omitempty"`
+	AccessAll *bool  `json:"access_all,omitempty"`
+	ReadOnly  *bool  `json:"read_only,omitempty"`
+}
+
+type syncKey struct {
+	Email   string
+	OrgUUID string
+	Target  string
+}
+
+type syncMember struct {
+	UUID      string
+	Email     string
+	OrgUUID   string
+	Atype     int32
+	Status    int32
+	AccessAll bool
+}
+
+type syncAssignment struct {
+	Email      string
+	OrgUUID    string
+	TargetUUID string
+	ReadOnly   bool
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// syncUsers plans the changes to reach the desired state, and applies
+// them in a transaction if apply.
+func (m *VMManager) syncUsers(req syncRequest, apply bool, caller *apiKey) ([]syncAction, error) {
+	if !apply {
+		plan, err := m.syncPlan(m.db, req)
+		if err != nil {
+			return nil, err
+		}
+		return plan, checkSyncGrants(caller, plan)
+	}
+
+	// derive keys of new users out of the transaction, it takes seconds
+	// of each user
+	draft, err := m.syncPlan(m.db, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSyncGrants(caller, draft); err != nil {
+		return nil, err
+	}
+	desiredUsers := map[string]syncUser{}
+	for _, u := range req.Users {
+		desiredUsers[u.Email] = u
+	}
+	keys := map[string]*userKeys{}
+	for _, a := range draft {
+		if a.Action != actCreateUser {
+			continue
+		}
+		u := desiredUsers[a.Email]
+		if keys[a.Email], err = newUserKeys(u.Email, u.Name, u.Password, pkcs.DefaultKdfParams(pkcs.KdfPBKDF2)); err != nil {
+			return nil, err
+		}
+	}
+
+	var plan []syncAction
+	var mails []*initialPasswordMail
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if plan, err = m.syncPlan(tx, req); err != nil {
+			return err
+		}
+		if err := checkSyncGrants(caller, plan); err != nil {
+			return err
+		}
+		mails, err = m.applySync(tx, plan, keys, caller.Name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// generated passwords of created users are only mailed after commit
+	return plan, m.sendInitialPasswords(mails...)
+}
+
+// checkSyncGrants checks roles granted, changed or revoked by the plan,
+// keeping an elevated role needs no elevated scope.
+func checkSyncGrants(caller *apiKey, plan []syncAction) error {
+	for _, a := range plan {
+		if a.Action != actCreateMembership && a.Action != actUpdateMembership && a.Action != actRevokeMembership {
+			continue
+		}
+		role, granted := roleName2ID[a.Role]
+		from, changed := roleName2ID[a.From]
+		if changed && granted && from == role {
+			continue
+		}
+		if changed {
+			if err := checkRoleRemoval(caller, from); err != nil {
+				return err
+			}
+		}
+		if granted {
+			if err := checkRoleGrant(caller, role); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *VMManager) syncPlan(tx *gorm.DB, req syncRequest) ([]syncAction, error) {
+	managed := map[string]struct{}{}
+	for _, orgUUID := range req.OrgUUIDs {
+		if _, ok := m.orgSymKeys[orgUUID]; !ok {
+			return nil, errors.Wrapf(gorm.ErrRecordNotFound, "fail to found org symmetric key of %s", orgUUID)
+		}
+		managed[orgUUID] = struct{}{}
+	}
+
+	// groups and collections to org
+	type orgObject struct {
+		UUID    string
+		OrgUUID string
+	}
+	groups := []orgObject{}
+	err := tx.Raw("SELECT uuid, organizations_uuid AS org_uuid FROM groups WHERE organizations_uuid IN ?", req.OrgUUIDs).
+		Scan(&groups).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query groups")
+	}
+	group2org := map[string]string{}
+	for _, g := range groups {
+		group2org[g.UUID] = g.OrgUUID
+	}
+	cols := []model.Collection{}
+	if err := tx.Where("org_uuid IN ?", req.OrgUUIDs).Find(&cols).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query collections")
+	}
+	col2org := map[string]string{}
+	for _, c := range cols {
+		col2org[c.UUID] = c.OrgUUID
+	}
+
+	// desired state
+	desiredUsers := map[string]syncUser{}
+	desiredMembers := map[syncKey]syncMembership{}
+	desiredGroups := map[syncKey]struct{}{}
+	desiredCols := map[syncKey]bool{}
+	emails := []string{}
+	for _, u := range req.Users {
+		if _, ok := desiredUsers[u.Email]; ok {
+			return nil, errors.Wrapf(errInvalidSync, "duplicated user %s", u.Email)
+		}
+		desiredUsers[u.Email] = u
+		emails = append(emails, u.Email)
+
+		for _, o := range u.Orgs {
+			if _, ok := managed[o.UUID]; !ok {
+				return nil, errors.Wrapf(errInvalidSync, "org %s of %s is not in org_uuids", o.UUID, u.Email)
+			}
+			key := syncKey{Email: u.Email, OrgUUID: o.UUID}
+			if _, ok := desiredMembers[key]; ok {
+				return nil, errors.Wrapf(errInvalidSync, "duplicated org %s of %s", o.UUID, u.Email)
+			}
+			desiredMembers[key] = o
+
+			for _, g := range o.Groups {
+				if group2org[g] != o.UUID {
+					return nil, errors.Wrapf(errInvalidSync, "group %s is not found in org %s", g, o.UUID)
+				}
+				desiredGroups[syncKey{Email: u.Email, OrgUUID: o.UUID, Target: g}] = struct{}{}
+			}
+			for _, c := range o.Collections {
+				if col2org[c.UUID] != o.UUID {
+					return nil, errors.Wrapf(errInvalidSync, "collection %s is not found in org %s", c.UUID, o.UUID)
+				}
+				desiredCols[syncKey{Email: u.Email, OrgUUID: o.UUID, Target: c.UUID}] = c.ReadOnly
+			}
+		}
+	}
+
+	// the service account keeps memberships not listed, or mgr loses org keys
+	protected := func(email, orgUUID string) bool {
+		if email != m.saEmail {
+			return false
+		}
+		_, ok := desiredMembers[syncKey{Email: email, OrgUUID: orgUUID}]
+		return !ok
+	}
+
+	// current state
+	existing := []model.User{}
+	if len(emails) > 0 {
+		if err := tx.Where("email IN ?", emails).Find(&existing).Error; err != nil {
+			return nil, errors.Wrap(err, "fail to query users")
+		}
+	}
+	existingUsers := map[string]struct{}{}
+	for _, u := range existing {
+		existingUsers[u.Email] = struct{}{}
+	}
+
+	members := []syncMember{}
+	err = tx.Raw(`
+	SELECT
+		uo.uuid,
+		u.email,
+		uo.org_uuid,
+		uo.atype,
+		uo.status,
+		uo.access_all
+	FROM
+		users_organizations uo
+		INNER JOIN users u ON u.uuid = uo.user_uuid
+	WHERE
+		uo.org_uuid IN ?
+	`, req.OrgUUIDs).Scan(&members).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query memberships")
+	}
+	currentMembers := map[syncKey]syncMember{}
+	for _, um := range members {
+		currentMembers[syncKey{Email: um.Email, OrgUUID: um.OrgUUID}] = um
+	}
+
+	userGroups := []syncAssignment{}
+	err = tx.Raw(`
+	SELECT
+		u.email,
+		uo.org_uuid,
+		gu.groups_uuid AS target_uuid
+	FROM
+		groups_users gu
+		INNER JOIN users_organizations uo ON uo.uuid = gu.users_organizations_uuid
+		INNER JOIN users u ON u.uuid = uo.user_uuid
+	WHERE
+		uo.org_uuid IN ?
+	`, req.OrgUUIDs).Scan(&userGroups).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query group memberships")
+	}
+
+	userCols := []syncAssignment{}
+	err = tx.Raw(`
+	SELECT
+		u.email,
+		c.org_uuid,
+		uc.collection_uuid AS target_uuid,
+		uc.read_only
+	FROM
+		users_collections uc
+		INNER JOIN collections c ON c.uuid = uc.collection_uuid
+		INNER JOIN users u ON u.uuid = uc.user_uuid
+	WHERE
+		c.org_uuid IN ?
+	`, req.OrgUUIDs).Scan(&userCols).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query collection assignments")
+	}
+
+	// diff
+	plan := []syncAction{}
+	for _, email := range emails {
+		if _, ok := existingUsers[email]; ok {
+			continue
+		}
+		if desiredUsers[email].Password == "" && m.mailer == nil {
+			return nil, errors.Wrapf(errInvalidSync, "password is required to create %s without mailer", email)
+		}
+		plan = append(plan, syncAction{Action: actCreateUser, Email: email})
+	}
+
+	for key, d := range desiredMembers {
+		c, ok := currentMembers[key]
+		a := syncAction{
+			Email:     key.Email,
+			OrgUUID:   key.OrgUUID,
+			Role:      roleID2Name[roleName2ID[d.Role]],
+			AccessAll: boolPtr(d.AccessAll),
+		}
+		switch {
+		case !ok:
+			a.Action = actCreateMembership
+		case c.Status < 0:
+			a.Action, a.From = actUpdateMembership, statusName(c.Status)
+		case c.Atype != roleName2ID[d.Role] || c.AccessAll != d.AccessAll:
+			a.Action, a.From = actUpdateMembership, roleID2Name[c.Atype]
+		default:
+			continue
+		}
+		plan = append(plan, a)
+	}
+	for key, c := range currentMembers {
+		if _, ok := desiredMembers[key]; ok || c.Status < 0 || protected(key.Email, key.OrgUUID) {
+			continue
+		}
+		plan = append(plan, syncAction{
+			Action:  actRevokeMembership,
+			Email:   key.Email,
+			OrgUUID: key.OrgUUID,
+			From:    roleID2Name[c.Atype],
+		})
+	}
+
+	currentGroups := map[syncKey]struct{}{}
+	for _, ug := range userGroups {
+		key := syncKey{Email: ug.Email, OrgUUID: ug.OrgUUID, Target: ug.TargetUUID}
+		currentGroups[key] = struct{}{}
+		if _, ok := desiredGroups[key]; !ok && !protected(key.Email, key.OrgUUID) {
+			plan = append(plan, syncAction{Action: actRemoveGroup, Email: key.Email, OrgUUID: key.OrgUUID, Target: key.Target})
+		}
+	}
+	for key := range desiredGroups {
+		if _, ok := currentGroups[key]; !ok {
+			plan = append(plan, syncAction{Action: actAddGroup, Email: key.Email, OrgUUID: key.OrgUUID, Target: key.Target})
+		}
+	}
+
+	currentCols := map[syncKey]bool{}
+	for _, uc := range userCols {
+		key := syncKey{Email: uc.Email, OrgUUID: uc.OrgUUID, Target: uc.TargetUUID}
+		currentCols[key] = uc.ReadOnly
+		if _, ok := desiredCols[key]; !ok && !protected(key.Email, key.OrgUUID) {
+			plan = append(plan, syncAction{Action: actRemoveCollection, Email: key.Email, OrgUUID: key.OrgUUID, Target: key.Target})
+		}
+	}
+	for key, readOnly := range desiredCols {
+		a := syncAction{Email: key.Email, OrgUUID: key.OrgUUID, Target: key.Target, ReadOnly: boolPtr(readOnly)}
+		if current, ok := currentCols[key]; !ok {
+			a.Action = actAddCollection
+		} else if current != readOnly {
+			a.Action = actUpdateCollection
+		} else {
+			continue
+		}
+		plan = append(plan, a)
+	}
+
+	// stable for review
+	sort.Slice(plan, func(i, j int) bool {
+		a, b := plan[i], plan[j]
+		if a.Email != b.Email {
+			return a.Email < b.Email
+		}
+		if a.OrgUUID != b.OrgUUID {
+			return a.OrgUUID < b.OrgUUID
+		}
+		if a.Action != b.Action {
+			return syncActionRank[a.Action] < syncActionRank[b.Action]
+		}
+		return a.Target < b.Target
+	})
+	return plan, nil
+}
+
+// execRank orders actions to apply, owners are promoted before others
+// are demoted, see ensureNotLastOwner.
+func (a *syncAction) execRank() int {
+	rank := syncActionRank[a.Action] * 2
+	if a.Action == actUpdateMembership && a.Role != "owner" {
+		rank++
+	}
+	return rank
+}
+
+// applySync applies the plan, keys of users to create are derived before
+// the transaction.
+func (m *VMManager) applySync(tx *gorm.DB, plan []syncAction, keys map[string]*userKeys, actor string) ([]*initialPasswordMail, error) {
+	emails := []string{}
+	for _, a := range plan {
+		emails = append(emails, a.Email)
+	}
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	existing := []model.User{}
+	if err := tx.Where("email IN ?", emails).Find(&existing).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query users")
+	}
+	users := map[string]*model.User{}
+	for i := range existing {
+		users[existing[i].Email] = &existing[i]
+	}
+	pubs := map[string]*rsa.PublicKey{}
+
+	steps := append([]syncAction{}, plan...)
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].execRank() < steps[j].execRank()
+	})
+
+	mails := []*initialPasswordMail{}
+	counts := map[string]int{}
+	touched := map[string]struct{}{}
+	for _, a := range steps {
+		if a.Action == actCreateUser {
+			k, ok := keys[a.Email]
+			if !ok {
+				return nil, errors.Wrapf(errInvalidSync, "%s changed during sync, try again", a.Email)
+			}
+			user, mail, err := m.insertUser(tx, k, nil, actor, false)
+			if err != nil {
+				return nil, err
+			}
+			users[a.Email] = user
+			mails = append(mails, mail)
+			counts[a.Action]++
+			continue
+		}
+
+		user := users[a.Email]
+		var err error
+		switch a.Action {
+		case actCreateMembership, actUpdateMembership:
+			pub, ok := pubs[a.Email]
+			if !ok {
+				if pub, err = userPublicKey(user); err != nil {
+					return nil, err
+				}
+				pubs[a.Email] = pub
+			}
+			_, err = m.upsertMembership(tx, actor, user, pub, a.OrgUUID, roleName2ID[a.Role], a.AccessAll)
+		case actRevokeMembership:
+			if a.From == roleID2Name[roleOwner] {
+				if err := ensureNotLastOwner(tx, a.OrgUUID, user.UUID); err != nil {
+					return nil, err
+				}
+			}
+			err = revokeMemberships(tx, "user_uuid = ? AND org_uuid = ?", user.UUID, a.OrgUUID).Error
+		case actAddGroup:
+			err = tx.Exec(`
+			INSERT INTO groups_users (groups_uuid, users_organizations_uuid)
+			SELECT ?, uuid FROM users_organizations WHERE user_uuid = ? AND org_uuid = ?
+			`, a.Target, user.UUID, a.OrgUUID).Error
+		case actRemoveGroup:
+			err = tx.Exec(`
+			DELETE FROM groups_users
+			WHERE groups_uuid = ? AND users_organizations_uuid IN (
+				SELECT uuid FROM users_organizations WHERE user_uuid = ? AND org_uuid = ?
+			)`, a.Target, user.UUID, a.OrgUUID).Error
+		case actAddCollection:
+			err = tx.Exec(`
+			INSERT INTO users_collections (user_uuid, collection_uuid, read_only, hide_passwords)
+			VALUES (?, ?, ?, FALSE)
+			`, user.UUID, a.Target, *a.ReadOnly).Error
+		case actUpdateCollection:
+			err = tx.Exec("UPDATE users_collections SET read_only = ? WHERE user_uuid = ? AND collection_uuid = ?",
+				*a.ReadOnly, user.UUID, a.Target).Error
+		case actRemoveCollection:
+			err = tx.Exec("DELETE FROM users_collections WHERE user_uuid = ? AND collection_uuid = ?",
+				user.UUID, a.Target).Error
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to %s of %s", a.Action, a.Email)
+		}
+		counts[a.Action]++
+		touched[user.UUID] = struct{}{}
+	}
+
+	if len(touched) > 0 {
+		userUUIDs := make([]string, 0, len(touched))
+		for u := range touched {
+			userUUIDs = append(userUUIDs, u)
+		}
+		err := tx.Model(&model.User{}).Where("uuid IN ?", userUUIDs).
+			Update("updated_at", time.Now().UTC()).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mails, writeAudit(tx, actor, "sync", "", counts)
+}
@@ -0,0 +1,264 @@
+package mgr
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	enforceRevoke = "revoke"
+	enforceWait   = "wait"
+	enforceSkip   = "skip"
+)
+
+var (
+	// providers of twofactor.atype, see has2FASQL
+	twoFactorProviders = map[int32]string{
+		0: "authenticator",
+		1: "email",
+		2: "duo",
+		3: "yubikey",
+		4: "u2f",
+		6: "org_duo",
+		7: "webauthn",
+	}
+
+	// rolls back dry runs, never returned
+	errDryRun = errors.New("dry run")
+)
+
+type twoFactorQuery struct {
+	OrgUUID string `form:"org_uuid" binding:"omitempty,uuid"`
+	Has2FA  *bool  `form:"has_2fa"`
+}
+
+type twoFactorMember struct {
+	Email     string   `json:"email"`
+	Role      string   `json:"role"`
+	Status    string   `json:"status"`
+	Providers []string `json:"providers"`
+}
+
+type twoFactorOrg struct {
+	OrgUUID      string            `json:"org_uuid"`
+	OrgName      string            `json:"org_name"`
+	MemberCount  int               `json:"member_count"`
+	EnabledCount int               `json:"enabled_count"`
+	Members      []twoFactorMember `json:"members"`
+}
+
+// memberTwoFactor is an active membership with enabled 2FA providers
+type memberTwoFactor struct {
+	OrgUUID      string
+	OrgName      string
+	UserUUID     string
+	Email        string
+	Atype        int32
+	MemberStatus int32
+	CreatedAt    time.Time
+	LegacyTotp   bool
+	// comma separated twofactor.atype
+	ProviderTypes *string
+}
+
+func (mt *memberTwoFactor) providers() []string {
+	names := map[string]struct{}{}
+	if mt.LegacyTotp {
+		names[twoFactorProviders[0]] = struct{}{}
+	}
+	if mt.ProviderTypes != nil {
+		for _, s := range strings.Split(*mt.ProviderTypes, ",") {
+			t, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				continue
+			}
+			names[twoFactorProviders[int32(t)]] = struct{}{}
+		}
+	}
+	results := make([]string, 0, len(names))
+	for n := range names {
+		results = append(results, n)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// memberTwoFactors lists members not revoked of all orgs, or the given one
+func memberTwoFactors(tx *gorm.DB, orgUUID string) ([]memberTwoFactor, error) {
+	types := make([]int32, 0, len(twoFactorProviders))
+	for t := range twoFactorProviders {
+		types = append(types, t)
+	}
+
+	members := []memberTwoFactor{}
+	err := tx.Raw(`
+	SELECT
+		uo.org_uuid,
+		o.name AS org_name,
+		u.uuid AS user_uuid,
+		u.email,
+		uo.atype,
+		uo.status AS member_status,
+		u.created_at,
+		u.totp_secret IS NOT NULL AS legacy_totp,
+		string_agg(tf.atype::TEXT, ',') AS provider_types
+	FROM
+		users_organizations uo
+		INNER JOIN organizations o ON o.uuid = uo.org_uuid
+		INNER JOIN users u ON u.uuid = uo.user_uuid
+		LEFT JOIN twofactor tf ON tf.user_uuid = u.uuid AND tf.enabled = TRUE AND tf.atype IN ?
+	WHERE
+		uo.status >= 0 AND (? = '' OR uo.org_uuid = ?)
+	GROUP BY
+		1, 2, 3, 4, 5, 6, 7, 8
+	ORDER BY
+		o.name, u.email
+	`, types, orgUUID, orgUUID).Scan(&members).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query 2FA of members")
+	}
+	return members, nil
+}
+
+func (m *VMManager) twoFactorReport(q twoFactorQuery) ([]twoFactorOrg, error) {
+	members, err := memberTwoFactors(m.db, q.OrgUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []twoFactorOrg{}
+	for i := range members {
+		mt := &members[i]
+		if len(results) == 0 || results[len(results)-1].OrgUUID != mt.OrgUUID {
+			results = append(results, twoFactorOrg{
+				OrgUUID: mt.OrgUUID,
+				OrgName: mt.OrgName,
+				Members: []twoFactorMember{},
+			})
+		}
+		r := &results[len(results)-1]
+
+		providers := mt.providers()
+		r.MemberCount++
+		if len(providers) > 0 {
+			r.EnabledCount++
+		}
+		if q.Has2FA != nil && *q.Has2FA != (len(providers) > 0) {
+			continue
+		}
+		r.Members = append(r.Members, twoFactorMember{
+			Email:     mt.Email,
+			Role:      roleID2Name[mt.Atype],
+			Status:    statusName(mt.MemberStatus),
+			Providers: providers,
+		})
+	}
+	return results, nil
+}
+
+type enforce2FAQuery struct {
+	DryRun bool `form:"dry_run"`
+}
+
+type enforce2FAInfo struct {
+	GraceDays int `json:"grace_days" binding:"min=0,max=365"`
+	// announcement of the policy, grace period starts from it, or from
+	// creation of users joined later
+	Since *time.Time `json:"since"`
+}
+
+type enforce2FAResult struct {
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	Status   string    `json:"status"`
+	Deadline time.Time `json:"deadline"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// enforce2FA revokes members of org without 2FA after the grace period.
+// Dry runs go through the same transaction and roll it back, so results
+// are the same as a real run, e.g. for last owners.
+func (m *VMManager) enforce2FA(orgUUID string, info enforce2FAInfo, dryRun bool, actor string) ([]enforce2FAResult, error) {
+	if _, err := m.orgSymKey(orgUUID); err != nil {
+		return nil, err
+	}
+
+	results := []enforce2FAResult{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		members, err := memberTwoFactors(tx, orgUUID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		revoked := []string{}
+		for i := range members {
+			mt := &members[i]
+			if len(mt.providers()) > 0 {
+				continue
+			}
+
+			start := mt.CreatedAt
+			if info.Since != nil && info.Since.After(start) {
+				start = *info.Since
+			}
+			r := enforce2FAResult{
+				Email:    mt.Email,
+				Role:     roleID2Name[mt.Atype],
+				Status:   statusName(mt.MemberStatus),
+				Deadline: start.AddDate(0, 0, info.GraceDays).UTC(),
+				Action:   enforceRevoke,
+			}
+
+			switch {
+			case now.Before(r.Deadline):
+				r.Action = enforceWait
+			case mt.Email == m.saEmail:
+				r.Action, r.Reason = enforceSkip, "service account"
+			case mt.Atype == roleOwner:
+				if err := ensureNotLastOwner(tx, orgUUID, mt.UserUUID); err != nil {
+					if !errors.Is(err, errLastOwner) {
+						return err
+					}
+					r.Action, r.Reason = enforceSkip, "last owner"
+				}
+			}
+
+			if r.Action == enforceRevoke {
+				err := revokeMemberships(tx, "user_uuid = ? AND org_uuid = ?", mt.UserUUID, orgUUID).Error
+				if err != nil {
+					return errors.Wrapf(err, "fail to revoke membership of %s", mt.Email)
+				}
+				err = tx.Model(&model.User{}).Where("uuid = ?", mt.UserUUID).Update("updated_at", now).Error
+				if err != nil {
+					return err
+				}
+				revoked = append(revoked, mt.Email)
+			}
+			results = append(results, r)
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		if len(revoked) == 0 {
+			return nil
+		}
+		return writeAudit(tx, actor, "enforce_2fa", orgUUID, map[string]interface{}{
+			"grace_days": info.GraceDays,
+			"since":      info.Since,
+			"revoked":    revoked,
+		})
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,152 @@
+package mgr
+
+import (
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/imtaco/vwmgr/pkg/vault"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// same as Bitwarden clients
+	maxPasswordHistory = 5
+)
+
+var (
+	errAmbiguousItem = errors.New("more than one item matched")
+	errNotLoginItem  = errors.New("item is not a login")
+)
+
+type rotateItemInfo struct {
+	ItemUUID       string `json:"item_uuid" binding:"omitempty,uuid"`
+	CollectionUUID string `json:"collection_uuid" binding:"required_without=ItemUUID,omitempty,uuid"`
+	Name           string `json:"name" binding:"required_without=ItemUUID,max=1000"`
+	Password       string `json:"password" binding:"required,max=5000"`
+}
+
+// rotateOrgItemPassword replaces password of a login item, the old one
+// is kept in password history as Bitwarden clients do.
+func (m *VMManager) rotateOrgItemPassword(orgUUID string, info rotateItemInfo) (string, error) {
+	orgSymKey, err := m.orgSymKey(orgUUID)
+	if err != nil {
+		return "", err
+	}
+
+	itemUUID := info.ItemUUID
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if itemUUID == "" {
+			var err error
+			itemUUID, err = findOrgItemByName(tx, orgSymKey, orgUUID, info.CollectionUUID, info.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		c := model.Cipher{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("uuid = ? AND organization_uuid = ? AND deleted_at IS NULL", itemUUID, orgUUID).
+			First(&c).Error
+		if err != nil {
+			return errors.Wrapf(err, "fail to find item %s", itemUUID)
+		}
+
+		v, err := vault.Decrypt(&c, orgSymKey)
+		if err != nil {
+			return err
+		}
+		if v.Login == nil {
+			return errNotLoginItem
+		}
+
+		now := time.Now().UTC()
+		setLoginPassword(v, info.Password, now)
+
+		enc, err := vault.Encrypt(v, orgSymKey)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&model.Cipher{}).Where("uuid = ?", c.UUID).
+			Updates(map[string]interface{}{
+				"name":             enc.Name,
+				"notes":            enc.Notes,
+				"fields":           enc.Fields,
+				"data":             enc.Data,
+				"password_history": enc.PasswordHistory,
+				"updated_at":       now,
+			}).Error
+		if err != nil {
+			return err
+		}
+		return touchOrgUsers(tx, orgUUID, now)
+	})
+	if err != nil {
+		return "", err
+	}
+	return itemUUID, nil
+}
+
+func setLoginPassword(v *vault.Cipher, password string, now time.Time) {
+	old := v.Login.Password
+	if old == password {
+		return
+	}
+	if old != "" {
+		history := []vault.PasswordHistory{{Password: old, LastUsedDate: now}}
+		history = append(history, v.PasswordHistory...)
+		if len(history) > maxPasswordHistory {
+			history = history[:maxPasswordHistory]
+		}
+		v.PasswordHistory = history
+	}
+	v.Login.Password = password
+	v.Login.PasswordRevisionDate = &now
+}
+
+// findOrgItemByName finds a single item in collection by decrypted name
+func findOrgItemByName(
+	tx *gorm.DB,
+	orgSymKey []byte,
+	orgUUID string,
+	colUUID string,
+	name string,
+) (string, error) {
+	ciphers := []model.Cipher{}
+	err := tx.Model(&model.Cipher{}).
+		Select("ciphers.uuid, ciphers.name, ciphers.key").
+		Joins("INNER JOIN ciphers_collections cc ON cc.cipher_uuid = ciphers.uuid").
+		Where("cc.collection_uuid = ? AND ciphers.organization_uuid = ? AND ciphers.deleted_at IS NULL", colUUID, orgUUID).
+		Find(&ciphers).Error
+	if err != nil {
+		return "", err
+	}
+
+	found := []string{}
+	for _, c := range ciphers {
+		key := orgSymKey
+		if c.Key != nil && *c.Key != "" {
+			if key, err = pkcs.BWSymDecrypt(orgSymKey, *c.Key); err != nil {
+				return "", errors.Wrapf(err, "fail to decrypt key of cipher %s", c.UUID)
+			}
+		}
+		n, err := pkcs.BWSymDecrypt(key, c.Name)
+		if err != nil {
+			return "", errors.Wrapf(err, "fail to decrypt name of cipher %s", c.UUID)
+		}
+		if string(n) == name {
+			found = append(found, c.UUID)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", errors.Wrapf(gorm.ErrRecordNotFound, "no item named %q in collection %s", name, colUUID)
+	case 1:
+		return found[0], nil
+	default:
+		return "", errors.Wrapf(errAmbiguousItem, "%d items named %q in collection %s", len(found), name, colUUID)
+	}
+}
@@ -0,0 +1,333 @@
+package mgr
+
+import (
+	"sort"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+var (
+	errSuccessorNotMember = errors.New("successor is not a confirmed member of org")
+	errInvalidSuccessor   = errors.New("successor must be another user")
+
+	// event types of Vaultwarden changing a cipher: created, updated,
+	// attachment created and shared to org
+	cipherChangeEvents = []int32{1100, 1101, 1103, 1105}
+)
+
+type departInfo struct {
+	Successor string `json:"successor" binding:"required,email,max=64"`
+}
+
+type departCollection struct {
+	OrgUUID        string `json:"org_uuid"`
+	OrgName        string `json:"org_name"`
+	CollectionUUID string `json:"collection_uuid"`
+	CollectionName string `json:"collection_name"`
+}
+
+type departRotateItem struct {
+	CollectionUUID string    `json:"collection_uuid"`
+	CollectionName string    `json:"collection_name"`
+	ItemUUID       string    `json:"item_uuid"`
+	ItemName       string    `json:"item_name"`
+	AccountName    string    `json:"account_name"`
+	ModifiedAt     time.Time `json:"modified_at"`
+	// set if the item can not be decrypted, it still needs rotation
+	Error string `json:"error,omitempty"`
+}
+
+type departResult struct {
+	Successor   string             `json:"successor"`
+	Collections []departCollection `json:"collections"`
+	RotateItems []departRotateItem `json:"rotate_items"`
+	// false if any org of the collections has no events, rotate_items
+	// is incomplete then
+	EventsAvailable bool         `json:"events_available"`
+	Steps           []stepResult `json:"steps"`
+}
+
+// orgsWithEvents tells orgs having any event, Vaultwarden only writes
+// events of orgs if ORG_EVENTS_ENABLED
+func orgsWithEvents(tx *gorm.DB, orgUUIDs []string) (map[string]bool, error) {
+	found := map[string]bool{}
+	if len(orgUUIDs) == 0 {
+		return found, nil
+	}
+	rows := []string{}
+	err := tx.Raw(`
+	SELECT
+		o.uuid
+	FROM
+		organizations o
+	WHERE
+		o.uuid IN ? AND EXISTS (SELECT 1 FROM event e WHERE e.org_uuid = o.uuid)
+	`, orgUUIDs).Scan(&rows).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query events of orgs")
+	}
+	for _, u := range rows {
+		found[u] = true
+	}
+	return found, nil
+}
+
+// soleEditorCollections lists collections where user is the only one
+// who can edit or manage, among confirmed members. Access of owners,
+// admins and access_all counts as well.
+func soleEditorCollections(tx *gorm.DB, userUUID string) ([]departCollection, error) {
+	cols := []departCollection{}
+	err := tx.Raw(`
+	SELECT
+		c.org_uuid,
+		o.name AS org_name,
+		c.uuid AS collection_uuid,
+		c.name AS collection_name
+	FROM
+		users_collections_access uce
+		INNER JOIN collections c ON c.uuid = uce.collection_uuid
+		INNER JOIN organizations o ON o.uuid = c.org_uuid
+	WHERE
+		uce.user_uuid = ?
+		AND uce.user_org_status >= 0
+		AND (uce.manage = TRUE OR uce.read_only = FALSE)
+		AND NOT EXISTS (
+			SELECT 1 FROM users_collections_access other
+			WHERE other.collection_uuid = uce.collection_uuid
+				AND other.user_uuid != uce.user_uuid
+				AND other.user_org_status = ?
+				AND (other.manage = TRUE OR other.read_only = FALSE)
+		)
+	`, userUUID, statusConfirmed).Scan(&cols).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query collections of sole editor")
+	}
+	return cols, nil
+}
+
+// lastModifiedItems lists items in collections whose last change is
+// made by user, by events of Vaultwarden. Nothing is found if org events
+// are not enabled.
+func lastModifiedItems(tx *gorm.DB, userUUID string, colUUIDs []string) ([]collectionItem, []time.Time, error) {
+	rows := []struct {
+		collectionItem
+		ModifiedAt time.Time
+	}{}
+	err := tx.Raw(`
+	WITH last_changes AS (
+		SELECT DISTINCT ON (e.cipher_uuid)
+			e.cipher_uuid,
+			e.act_user_uuid,
+			e.event_date
+		FROM
+			event e
+		WHERE
+			e.cipher_uuid IS NOT NULL AND e.event_type IN ?
+		ORDER BY
+			e.cipher_uuid, e.event_date DESC
+	)
+	SELECT
+		c.org_uuid,
+		o.name AS org_name,
+		c.uuid AS collection_uuid,
+		c.name AS collection_name,
+		p.uuid AS item_uuid,
+		p.atype AS item_type,
+		p.name AS item_name,
+		p.data AS item_data,
+		p.key AS item_key,
+		p.password_history,
+		p.created_at,
+		p.updated_at,
+		lc.event_date AS modified_at
+	FROM
+		ciphers_collections cc
+		INNER JOIN collections c ON c.uuid = cc.collection_uuid
+		INNER JOIN organizations o ON o.uuid = c.org_uuid
+		INNER JOIN ciphers p ON p.uuid = cc.cipher_uuid
+		INNER JOIN last_changes lc ON lc.cipher_uuid = p.uuid
+	WHERE
+		cc.collection_uuid IN ? AND p.deleted_at IS NULL AND lc.act_user_uuid = ?
+	`, cipherChangeEvents, colUUIDs, userUUID).Scan(&rows).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fail to query items last modified by user")
+	}
+
+	items := make([]collectionItem, 0, len(rows))
+	times := make([]time.Time, 0, len(rows))
+	for _, r := range rows {
+		items = append(items, r.collectionItem)
+		times = append(times, r.ModifiedAt)
+	}
+	return items, times, nil
+}
+
+// departUser hands collections over to the successor before revoking the
+// leaver. The successor is granted manage on collections where the leaver
+// is the only editor, items there last modified by the leaver are listed
+// to rotate, then the leaver is offboarded. It is one transaction with
+// one audit record.
+func (m *VMManager) departUser(email, successor, actor string) (*departResult, error) {
+	if email == successor {
+		return nil, errInvalidSuccessor
+	}
+
+	result := &departResult{
+		Successor:       successor,
+		Collections:     []departCollection{},
+		RotateItems:     []departRotateItem{},
+		EventsAvailable: true,
+	}
+	r := stepRunner{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		r.tx = tx
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+		succ, err := findUserByEmail(tx, successor)
+		if err != nil {
+			return errors.Wrapf(err, "successor %s", successor)
+		}
+
+		cols, err := soleEditorCollections(tx, user.UUID)
+		if err != nil {
+			return err
+		}
+		colUUIDs := make([]string, 0, len(cols))
+		orgUUIDs := map[string]struct{}{}
+		for i := range cols {
+			c := &cols[i]
+			orgSymKey, err := m.orgSymKey(c.OrgUUID)
+			if err != nil {
+				return err
+			}
+			name, err := pkcs.BWSymDecrypt(orgSymKey, c.CollectionName)
+			if err != nil {
+				return errors.Wrapf(err, "fail to decrypt name of collection %s", c.CollectionUUID)
+			}
+			c.CollectionName = string(name)
+			colUUIDs = append(colUUIDs, c.CollectionUUID)
+			orgUUIDs[c.OrgUUID] = struct{}{}
+		}
+
+		for orgUUID := range orgUUIDs {
+			var count int64
+			err := tx.Model(&model.UsersOrganization{}).
+				Where("user_uuid = ? AND org_uuid = ? AND status = ?", succ.UUID, orgUUID, statusConfirmed).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return errors.Wrapf(errSuccessorNotMember, "%s of org %s", successor, orgUUID)
+			}
+		}
+
+		// grants already in place are left untouched, so only real grants
+		// are counted
+		if err := r.run("grant_successor", func(tx *gorm.DB) *gorm.DB {
+			return tx.Exec(`
+			INSERT INTO users_collections (user_uuid, collection_uuid, read_only, hide_passwords, manage)
+			SELECT ?, uuid, FALSE, FALSE, TRUE FROM collections WHERE uuid IN ?
+			ON CONFLICT (user_uuid, collection_uuid) DO UPDATE SET
+				read_only = EXCLUDED.read_only,
+				hide_passwords = EXCLUDED.hide_passwords,
+				manage = EXCLUDED.manage
+			WHERE
+				users_collections.manage = FALSE
+				OR users_collections.read_only = TRUE
+				OR users_collections.hide_passwords = TRUE
+			`, succ.UUID, colUUIDs)
+		}); err != nil {
+			return err
+		}
+		if err := r.run("touch_successor", func(tx *gorm.DB) *gorm.DB {
+			return tx.Model(&model.User{}).Where("uuid = ?", succ.UUID).Update("updated_at", time.Now().UTC())
+		}); err != nil {
+			return err
+		}
+
+		if len(colUUIDs) > 0 {
+			orgList := make([]string, 0, len(orgUUIDs))
+			for orgUUID := range orgUUIDs {
+				orgList = append(orgList, orgUUID)
+			}
+			withEvents, err := orgsWithEvents(tx, orgList)
+			if err != nil {
+				return err
+			}
+			result.EventsAvailable = len(withEvents) == len(orgList)
+
+			rows, times, err := lastModifiedItems(tx, user.UUID, colUUIDs)
+			if err != nil {
+				return err
+			}
+			items, failed, err := m.decryptCollectionItems(rows)
+			if err != nil {
+				return err
+			}
+			for i, row := range rows {
+				if msg, ok := failed[row.ItemUUID]; ok {
+					result.RotateItems = append(result.RotateItems, departRotateItem{
+						CollectionUUID: row.CollectionUUID,
+						CollectionName: row.CollectionName,
+						ItemUUID:       row.ItemUUID,
+						ModifiedAt:     times[i],
+						Error:          msg,
+					})
+					continue
+				}
+				item := items[row.ItemUUID]
+				result.RotateItems = append(result.RotateItems, departRotateItem{
+					CollectionUUID: row.CollectionUUID,
+					CollectionName: row.CollectionName,
+					ItemUUID:       item.UUID,
+					ItemName:       item.Name,
+					AccountName:    item.Username(),
+					ModifiedAt:     times[i],
+				})
+			}
+		}
+
+		if err := offboardUserTx(&r, user); err != nil {
+			return err
+		}
+
+		sort.Slice(cols, func(i, j int) bool {
+			if cols[i].OrgName != cols[j].OrgName {
+				return cols[i].OrgName < cols[j].OrgName
+			}
+			return cols[i].CollectionName < cols[j].CollectionName
+		})
+		sort.Slice(result.RotateItems, func(i, j int) bool {
+			a, b := result.RotateItems[i], result.RotateItems[j]
+			if a.CollectionName != b.CollectionName {
+				return a.CollectionName < b.CollectionName
+			}
+			return a.ItemName < b.ItemName
+		})
+		result.Collections = cols
+		result.Steps = r.results
+
+		rotateUUIDs := make([]string, 0, len(result.RotateItems))
+		for _, it := range result.RotateItems {
+			rotateUUIDs = append(rotateUUIDs, it.ItemUUID)
+		}
+		return writeAudit(tx, actor, "depart", email, map[string]interface{}{
+			"successor":        successor,
+			"collections":      colUUIDs,
+			"rotate_items":     rotateUUIDs,
+			"events_available": result.EventsAvailable,
+			"steps":            r.results,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -2,64 +2,238 @@ package mgr
 
 import (
 	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
 	"github.com/pkg/errors"
 )
 
-type leaveUserItem struct {
+// event types of Vaultwarden showing a cipher to the user, e.g. viewed,
+// password toggled visible or copied, and autofilled
+var cipherSeenEvents = []int32{1107, 1108, 1109, 1110, 1111, 1112, 1113, 1114}
+
+// leaveUserCollection is a collection the departing user can access, with
+// members left able to edit it
+type leaveUserCollection struct {
 	OrgUUID        string `json:"org_uuid"`
 	OrgName        string `json:"org_name"`
 	CollectionUUID string `json:"collection_uuid"`
 	CollectionName string `json:"collection_name"`
-	Email          string `json:"email"`
+	Access         string `json:"access"`
+	accessSource
+	Editors []string `json:"editors"`
+	// no one else can edit or manage it
+	Orphaned  bool  `json:"orphaned"`
+	ItemCount int64 `json:"item_count"`
+	// nil if the org has no events to tell
+	SeenItemCount *int64 `json:"seen_item_count"`
 }
 
-func (m *VMManager) userDepartReport(email string) ([]leaveUserItem, error) {
-	var items []leaveUserItem
+// departReport is what the departing user can access, personal items are
+// not handed over by depart and go with the account
+type departReport struct {
+	Email             string                `json:"email"`
+	PersonalItemCount int64                 `json:"personal_item_count"`
+	Collections       []leaveUserCollection `json:"collections"`
+}
 
+func (m *VMManager) userDepartReport(email string) (*departReport, error) {
 	// check user first
-	user := model.User{}
-	if err := m.db.Where("email = ?", email).First(&user).Error; err != nil {
+	user, err := findUserByEmail(m.db, email)
+	if err != nil {
 		return nil, err
 	}
 
+	report := &departReport{Email: email, Collections: []leaveUserCollection{}}
+	err = m.db.Model(&model.Cipher{}).
+		Where("user_uuid = ? AND organization_uuid IS NULL AND deleted_at IS NULL", user.UUID).
+		Count(&report.PersonalItemCount).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to count personal items")
+	}
+
+	rows := []struct {
+		OrgUUID        string
+		OrgName        string
+		CollectionUUID string
+		CollectionName string
+		Access         string
+		Direct         bool
+		GroupUUIDs     *string
+		UserOrgType    int32
+		ByRole         bool
+		ByAccessAll    bool
+		ItemCount      int64
+		SeenItemCount  int64
+	}{}
 	sql := `
 	WITH depart_user_collections AS (
 		SELECT
-			collection_uuid
+			collection_uuid,
+			CASE
+				WHEN manage = TRUE THEN 'manage'
+				WHEN read_only = FALSE THEN 'edit'
+				ELSE 'view'
+			END AS access,
+			direct,
+			group_uuids,
+			user_org_type,
+			by_role,
+			by_access_all
 		FROM
-			users_collections_expands
+			users_collections_access
 		WHERE
-			user_uuid IN (SELECT uuid FROM users WHERE email = ?)
+			user_uuid = ? AND user_org_status >= 0
 	),
-	users_collections_detail AS (
+	collection_items AS (
 		SELECT
-			uce.collection_uuid,
-			u.email
+			cc.collection_uuid,
+			count(*) AS item_count
 		FROM
-			users_collections_expands uce
-			INNER JOIN users u ON u.uuid = uce.user_uuid
+			ciphers_collections cc
+			INNER JOIN ciphers p ON p.uuid = cc.cipher_uuid
 		WHERE
-			(uce.manage = TRUE OR uce.read_only = FALSE)
-			AND u.email != ?
-			AND uce.user_org_status = 2
+			p.deleted_at IS NULL
+		GROUP BY
+			1
+	),
+	seen_items AS (
+		SELECT
+			cc.collection_uuid,
+			count(DISTINCT cc.cipher_uuid) AS seen_item_count
+		FROM
+			ciphers_collections cc
+			INNER JOIN ciphers p ON p.uuid = cc.cipher_uuid
+		WHERE
+			p.deleted_at IS NULL
+			AND EXISTS (
+				SELECT 1 FROM event e
+				WHERE e.cipher_uuid = cc.cipher_uuid AND e.act_user_uuid = ? AND e.event_type IN ?
+			)
+		GROUP BY
+			1
 	)
 	SELECT
-		c.org_uuid AS org_uuid,
-		o.name as org_name,
+		c.org_uuid,
+		o.name AS org_name,
 		c.uuid AS collection_uuid,
 		c.name AS collection_name,
-		ucd.email
+		duc.access,
+		duc.direct,
+		duc.group_uuids,
+		duc.user_org_type,
+		duc.by_role,
+		duc.by_access_all,
+		COALESCE(ci.item_count, 0) AS item_count,
+		COALESCE(si.seen_item_count, 0) AS seen_item_count
 	FROM
-		depart_user_collections ubc
-		INNER JOIN collections c ON c.uuid = ubc.collection_uuid
+		depart_user_collections duc
+		INNER JOIN collections c ON c.uuid = duc.collection_uuid
 		INNER JOIN organizations o ON o.uuid = c.org_uuid
-		LEFT JOIN users_collections_detail ucd ON ucd.collection_uuid = c.uuid
+		LEFT JOIN collection_items ci ON ci.collection_uuid = c.uuid
+		LEFT JOIN seen_items si ON si.collection_uuid = c.uuid
 	ORDER BY
-		1
+		o.name, c.uuid
 	`
+	seenEvents := append(append([]int32{}, cipherSeenEvents...), cipherChangeEvents...)
+	if err := m.db.Raw(sql, user.UUID, user.UUID, seenEvents).Scan(&rows).Error; err != nil {
+		return nil, errors.Wrap(err, "fail to query depart user collections")
+	}
+	if len(rows) == 0 {
+		return report, nil
+	}
+
+	colUUIDs := make([]string, 0, len(rows))
+	orgUUIDs := []string{}
+	seenOrgs := map[string]struct{}{}
+	for _, r := range rows {
+		colUUIDs = append(colUUIDs, r.CollectionUUID)
+		if _, ok := seenOrgs[r.OrgUUID]; !ok {
+			seenOrgs[r.OrgUUID] = struct{}{}
+			orgUUIDs = append(orgUUIDs, r.OrgUUID)
+		}
+	}
+
+	editors := []struct {
+		CollectionUUID string
+		Email          string
+	}{}
+	err = m.db.Raw(`
+	SELECT
+		uce.collection_uuid,
+		u.email
+	FROM
+		users_collections_access uce
+		INNER JOIN users u ON u.uuid = uce.user_uuid
+	WHERE
+		uce.collection_uuid IN ?
+		AND uce.user_uuid != ?
+		AND uce.user_org_status = ?
+		AND (uce.manage = TRUE OR uce.read_only = FALSE)
+	ORDER BY
+		u.email
+	`, colUUIDs, user.UUID, statusConfirmed).Scan(&editors).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query editors of collections")
+	}
+	col2editors := map[string][]string{}
+	for _, e := range editors {
+		col2editors[e.CollectionUUID] = append(col2editors[e.CollectionUUID], e.Email)
+	}
+
+	groups := []struct {
+		UUID string
+		Name string
+	}{}
+	err = m.db.Raw("SELECT uuid, name FROM groups WHERE organizations_uuid IN ?", orgUUIDs).Scan(&groups).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to query groups")
+	}
+	groupNames := map[string]string{}
+	for _, g := range groups {
+		groupNames[g.UUID] = g.Name
+	}
+
+	withEvents, err := orgsWithEvents(m.db, orgUUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		orgSymKey, err := m.orgSymKey(r.OrgUUID)
+		if err != nil {
+			return nil, err
+		}
+		colName, err := pkcs.BWSymDecrypt(orgSymKey, r.CollectionName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to decrypt name of collection %s", r.CollectionUUID)
+		}
 
-	if err := m.db.Raw(sql, email, email).Scan(&items).Error; err != nil {
-		return nil, errors.Wrap(err, "fail to query item details")
+		grant := accessGrant{
+			Direct:      r.Direct,
+			GroupUUIDs:  r.GroupUUIDs,
+			UserOrgType: r.UserOrgType,
+			ByRole:      r.ByRole,
+			ByAccessAll: r.ByAccessAll,
+		}
+		colEditors := col2editors[r.CollectionUUID]
+		if colEditors == nil {
+			colEditors = []string{}
+		}
+		col := leaveUserCollection{
+			OrgUUID:        r.OrgUUID,
+			OrgName:        r.OrgName,
+			CollectionUUID: r.CollectionUUID,
+			CollectionName: string(colName),
+			Access:         r.Access,
+			accessSource:   grant.source(groupNames),
+			Editors:        colEditors,
+			Orphaned:       len(colEditors) == 0,
+			ItemCount:      r.ItemCount,
+		}
+		if withEvents[r.OrgUUID] {
+			seen := r.SeenItemCount
+			col.SeenItemCount = &seen
+		}
+		report.Collections = append(report.Collections, col)
 	}
-	return items, nil
+	return report, nil
 }
@@ -0,0 +1,155 @@
+package mgr
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/imtaco/vwmgr/pkg/model"
+	"gorm.io/gorm"
+)
+
+// stepResult reports rows affected by each step of an operation
+type stepResult struct {
+	Step     string `json:"step"`
+	Affected int64  `json:"affected"`
+}
+
+type stepRunner struct {
+	tx      *gorm.DB
+	results []stepResult
+}
+
+// run executes a step, stops at the first error
+func (r *stepRunner) run(step string, fn func(tx *gorm.DB) *gorm.DB) error {
+	res := fn(r.tx)
+	if res.Error != nil {
+		return res.Error
+	}
+	r.results = append(r.results, stepResult{Step: step, Affected: res.RowsAffected})
+	return nil
+}
+
+// revokeMemberships revokes memberships matched by query the way
+// Vaultwarden does, revoked ones are left untouched
+func revokeMemberships(tx *gorm.DB, query interface{}, args ...interface{}) *gorm.DB {
+	return tx.Model(&model.UsersOrganization{}).
+		Where(query, args...).
+		Where("status >= 0").
+		Update("status", gorm.Expr("status - ?", statusRevokeDiff))
+}
+
+func findUserByEmail(tx *gorm.DB, email string) (*model.User, error) {
+	user := model.User{}
+	if err := tx.Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// setUserEnabled toggles users.enabled, disabling also kills sessions
+// by rotating the security stamp and removing devices.
+func (m *VMManager) setUserEnabled(email string, enabled bool) ([]stepResult, error) {
+	r := stepRunner{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		r.tx = tx
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+
+		step := "enable"
+		if !enabled {
+			step = "disable"
+		}
+		err = r.run(step, func(tx *gorm.DB) *gorm.DB {
+			return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+				Updates(map[string]interface{}{
+					"enabled":    enabled,
+					"updated_at": time.Now().UTC(),
+				})
+		})
+		if err != nil || enabled {
+			return err
+		}
+
+		if err := r.run("rotate_security_stamp", func(tx *gorm.DB) *gorm.DB {
+			return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+				Update("security_stamp", uuid.NewString())
+		}); err != nil {
+			return err
+		}
+		// refresh tokens live in devices
+		return r.run("delete_devices", func(tx *gorm.DB) *gorm.DB {
+			return tx.Exec("DELETE FROM devices WHERE user_uuid = ?", user.UUID)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.results, nil
+}
+
+// offboardUser revokes all org memberships of user, along with
+// direct collection assignments and group memberships.
+func (m *VMManager) offboardUser(email string) ([]stepResult, error) {
+	r := stepRunner{}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		r.tx = tx
+		user, err := findUserByEmail(tx, email)
+		if err != nil {
+			return err
+		}
+		return offboardUserTx(&r, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.results, nil
+}
+
+// offboardUserTx runs steps of offboarding in the transaction of runner
+func offboardUserTx(r *stepRunner, user *model.User) error {
+	owned := []model.UsersOrganization{}
+	err := r.tx.Where("user_uuid = ? AND atype = ? AND status >= 0", user.UUID, roleOwner).
+		Find(&owned).Error
+	if err != nil {
+		return err
+	}
+	for _, uo := range owned {
+		if err := ensureNotLastOwner(r.tx, uo.OrgUUID, user.UUID); err != nil {
+			return err
+		}
+	}
+
+	steps := []struct {
+		name string
+		fn   func(tx *gorm.DB) *gorm.DB
+	}{
+		{"remove_collections", func(tx *gorm.DB) *gorm.DB {
+			return tx.Exec("DELETE FROM users_collections WHERE user_uuid = ?", user.UUID)
+		}},
+		{"remove_groups", func(tx *gorm.DB) *gorm.DB {
+			return tx.Exec(`
+			DELETE FROM groups_users
+			WHERE users_organizations_uuid IN (
+				SELECT uuid FROM users_organizations WHERE user_uuid = ?
+			)`, user.UUID)
+		}},
+		{"revoke_memberships", func(tx *gorm.DB) *gorm.DB {
+			return revokeMemberships(tx, "user_uuid = ?", user.UUID)
+		}},
+		{"rotate_security_stamp", func(tx *gorm.DB) *gorm.DB {
+			return tx.Model(&model.User{}).Where("uuid = ?", user.UUID).
+				Updates(map[string]interface{}{
+					"security_stamp": uuid.NewString(),
+					"updated_at":     time.Now().UTC(),
+				})
+		}},
+	}
+	for _, s := range steps {
+		if err := r.run(s.name, s.fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package model
+
+import (
+	"time"
+)
+
+// table below is owned by Vaultwarden, not generated since mgr only
+// creates groups
+
+const TableNameGroup = "groups"
+
+// Group mapped from table <groups>
+type Group struct {
+	UUID              string    `gorm:"column:uuid;primaryKey" json:"uuid"`
+	OrganizationsUUID string    `gorm:"column:organizations_uuid;not null" json:"organizations_uuid"`
+	Name              string    `gorm:"column:name;not null" json:"name"`
+	AccessAll         bool      `gorm:"column:access_all;not null" json:"access_all"`
+	ExternalID        *string   `gorm:"column:external_id" json:"external_id"`
+	CreationDate      time.Time `gorm:"column:creation_date;not null" json:"creation_date"`
+	RevisionDate      time.Time `gorm:"column:revision_date;not null" json:"revision_date"`
+}
+
+// TableName Group's table name
+func (*Group) TableName() string {
+	return TableNameGroup
+}
@@ -0,0 +1,26 @@
+package model
+
+import (
+	"time"
+)
+
+// table below is owned by mgr, see migration/0003_api_keys.sql
+
+const TableNameMgrAPIKey = "mgr_api_keys"
+
+// MgrAPIKey mapped from table <mgr_api_keys>
+type MgrAPIKey struct {
+	UUID       string     `gorm:"column:uuid;primaryKey" json:"uuid"`
+	Name       string     `gorm:"column:name;not null" json:"name"`
+	KeyHash    string     `gorm:"column:key_hash;not null" json:"-"`
+	Scopes     string     `gorm:"column:scopes;not null" json:"scopes"`
+	CreatedAt  time.Time  `gorm:"column:created_at;not null" json:"created_at"`
+	ExpiresAt  *time.Time `gorm:"column:expires_at" json:"expires_at"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+	RevokedAt  *time.Time `gorm:"column:revoked_at" json:"revoked_at"`
+}
+
+// TableName MgrAPIKey's table name
+func (*MgrAPIKey) TableName() string {
+	return TableNameMgrAPIKey
+}
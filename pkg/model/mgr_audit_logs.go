@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+)
+
+// table below is owned by mgr, see migration/0004_audit_logs.sql
+
+const TableNameMgrAuditLog = "mgr_audit_logs"
+
+// MgrAuditLog mapped from table <mgr_audit_logs>
+type MgrAuditLog struct {
+	ID        int64     `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	CreatedAt time.Time `gorm:"column:created_at;not null" json:"created_at"`
+	Actor     string    `gorm:"column:actor;not null" json:"actor"`
+	Action    string    `gorm:"column:action;not null" json:"action"`
+	Target    string    `gorm:"column:target;not null" json:"target"`
+	Detail    string    `gorm:"column:detail;not null" json:"detail"`
+}
+
+// TableName MgrAuditLog's table name
+func (*MgrAuditLog) TableName() string {
+	return TableNameMgrAuditLog
+}
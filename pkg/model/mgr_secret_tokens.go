@@ -0,0 +1,58 @@
+package model
+
+import (
+	"time"
+)
+
+// tables below are owned by mgr, see migration/0002_secret_tokens.sql
+
+const (
+	TableNameMgrSecretToken           = "mgr_secret_tokens"
+	TableNameMgrSecretTokenCollection = "mgr_secret_token_collections"
+	TableNameMgrSecretAccessLog       = "mgr_secret_access_logs"
+)
+
+// MgrSecretToken mapped from table <mgr_secret_tokens>
+type MgrSecretToken struct {
+	UUID      string     `gorm:"column:uuid;primaryKey" json:"uuid"`
+	Name      string     `gorm:"column:name;not null" json:"name"`
+	TokenHash string     `gorm:"column:token_hash;not null" json:"-"`
+	CreatedAt time.Time  `gorm:"column:created_at;not null" json:"created_at"`
+	ExpiresAt *time.Time `gorm:"column:expires_at" json:"expires_at"`
+	RevokedAt *time.Time `gorm:"column:revoked_at" json:"revoked_at"`
+}
+
+// TableName MgrSecretToken's table name
+func (*MgrSecretToken) TableName() string {
+	return TableNameMgrSecretToken
+}
+
+// MgrSecretTokenCollection mapped from table <mgr_secret_token_collections>
+type MgrSecretTokenCollection struct {
+	TokenUUID      string `gorm:"column:token_uuid;primaryKey" json:"token_uuid"`
+	CollectionUUID string `gorm:"column:collection_uuid;primaryKey" json:"collection_uuid"`
+}
+
+// TableName MgrSecretTokenCollection's table name
+func (*MgrSecretTokenCollection) TableName() string {
+	return TableNameMgrSecretTokenCollection
+}
+
+// MgrSecretAccessLog mapped from table <mgr_secret_access_logs>
+type MgrSecretAccessLog struct {
+	ID         int64     `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	CreatedAt  time.Time `gorm:"column:created_at;not null" json:"created_at"`
+	TokenUUID  string    `gorm:"column:token_uuid;not null" json:"token_uuid"`
+	TokenName  string    `gorm:"column:token_name;not null" json:"token_name"`
+	ClientIP   string    `gorm:"column:client_ip;not null" json:"client_ip"`
+	Collection string    `gorm:"column:collection;not null" json:"collection"`
+	Item       string    `gorm:"column:item;not null" json:"item"`
+	Field      string    `gorm:"column:field;not null" json:"field"`
+	CipherUUID *string   `gorm:"column:cipher_uuid" json:"cipher_uuid"`
+	Status     int32     `gorm:"column:status;not null" json:"status"`
+}
+
+// TableName MgrSecretAccessLog's table name
+func (*MgrSecretAccessLog) TableName() string {
+	return TableNameMgrSecretAccessLog
+}
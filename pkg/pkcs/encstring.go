@@ -0,0 +1,211 @@
+package pkcs
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EncType is the leading number of a Bitwarden cipher string
+type EncType int
+
+const (
+	EncAesCbc256B64                   EncType = 0
+	EncAesCbc128HmacSha256B64         EncType = 1
+	EncAesCbc256HmacSha256B64         EncType = 2
+	EncRsa2048OaepSha256B64           EncType = 3
+	EncRsa2048OaepSha1B64             EncType = 4
+	EncRsa2048OaepSha256HmacSha256B64 EncType = 5
+	EncRsa2048OaepSha1HmacSha256B64   EncType = 6
+)
+
+// number of '|' separated pieces of each type
+var encTypePieces = map[EncType]int{
+	EncAesCbc256B64:                   2, // iv|data
+	EncAesCbc128HmacSha256B64:         3, // iv|data|mac
+	EncAesCbc256HmacSha256B64:         3, // iv|data|mac
+	EncRsa2048OaepSha256B64:           1, // data
+	EncRsa2048OaepSha1B64:             1, // data
+	EncRsa2048OaepSha256HmacSha256B64: 2, // data|mac
+	EncRsa2048OaepSha1HmacSha256B64:   2, // data|mac
+}
+
+// EncString is a parsed Bitwarden cipher string, e.g. "2.iv|data|mac"
+type EncString struct {
+	Type EncType
+	IV   []byte
+	Data []byte
+	MAC  []byte
+}
+
+// ParseEncString parses a cipher string of any encryption type.
+// Strings without the type prefix are treated as type 1 if they have
+// a MAC, or type 0 otherwise, like Bitwarden clients do for old data.
+func ParseEncString(s string) (*EncString, error) {
+	var encType EncType
+	var body string
+
+	if header, rest, found := strings.Cut(s, "."); found {
+		t, err := strconv.Atoi(header)
+		if err != nil {
+			return nil, errors.New("invalid Bitwarden cipher string header")
+		}
+		encType, body = EncType(t), rest
+	} else {
+		body = s
+		if strings.Count(s, "|") == 2 {
+			encType = EncAesCbc128HmacSha256B64
+		} else {
+			encType = EncAesCbc256B64
+		}
+	}
+
+	n, ok := encTypePieces[encType]
+	if !ok {
+		return nil, errors.Errorf("unsupported Bitwarden encryption type %d", encType)
+	}
+	pieces := strings.Split(body, "|")
+	if len(pieces) != n {
+		return nil, errors.Errorf("invalid Bitwarden cipher string of type %d", encType)
+	}
+	decoded, err := Base64DecodeMany(pieces...)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to decode base64")
+	}
+
+	e := &EncString{Type: encType}
+	switch encType {
+	case EncAesCbc256B64:
+		e.IV, e.Data = decoded[0], decoded[1]
+	case EncAesCbc128HmacSha256B64, EncAesCbc256HmacSha256B64:
+		e.IV, e.Data, e.MAC = decoded[0], decoded[1], decoded[2]
+	case EncRsa2048OaepSha256B64, EncRsa2048OaepSha1B64:
+		e.Data = decoded[0]
+	case EncRsa2048OaepSha256HmacSha256B64, EncRsa2048OaepSha1HmacSha256B64:
+		e.Data, e.MAC = decoded[0], decoded[1]
+	}
+
+	if e.IsSymmetric() && len(e.IV) != 16 {
+		return nil, errors.New("invalid IV length")
+	}
+	if len(e.Data) == 0 {
+		return nil, errors.New("empty encrypted data")
+	}
+	return e, nil
+}
+
+func (e *EncString) String() string {
+	pieces := []string{}
+	if e.IsSymmetric() {
+		pieces = append(pieces, Base64Encode(e.IV))
+	}
+	pieces = append(pieces, Base64Encode(e.Data))
+	if e.MAC != nil {
+		pieces = append(pieces, Base64Encode(e.MAC))
+	}
+	return fmt.Sprintf("%d.%s", e.Type, strings.Join(pieces, "|"))
+}
+
+func (e *EncString) IsSymmetric() bool {
+	return e.Type <= EncAesCbc256HmacSha256B64
+}
+
+// Decrypt decrypts symmetric types with a 32 or 64 bytes key
+func (e *EncString) Decrypt(key []byte) ([]byte, error) {
+	if !e.IsSymmetric() {
+		return nil, errors.Errorf("type %d is not a symmetric encryption", e.Type)
+	}
+
+	var encKey, macKey []byte
+	switch e.Type {
+	case EncAesCbc256B64:
+		encKey = key
+		if len(key) == 64 {
+			encKey = key[:32]
+		}
+	case EncAesCbc128HmacSha256B64:
+		if len(key) != 32 {
+			return nil, errors.New("invalid key length for AES-128")
+		}
+		encKey, macKey = key[:16], key[16:]
+	default:
+		encKey, macKey = deriveEncMacKey(key)
+	}
+
+	if macKey != nil {
+		macData := append([]byte{}, e.IV...)
+		macData = append(macData, e.Data...)
+		expectedMac := HMACSha256(macKey, macData)
+
+		if len(e.MAC) != len(expectedMac) {
+			return nil, errors.New("MAC length mismatch")
+		}
+		if !hmac.Equal(e.MAC, expectedMac) {
+			return nil, errors.New("MAC validation failed - wrong masterKey or tampered data")
+		}
+	}
+
+	plaintext, err := aes256cbcDecrypt(e.Data, encKey, e.IV)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to decrypt")
+	}
+	return plaintext, nil
+}
+
+// DecryptPK decrypts RSA types with private key.
+// MAC of type 5 and 6 is not verified, which is the same as Bitwarden clients.
+func (e *EncString) DecryptPK(pri *rsa.PrivateKey) ([]byte, error) {
+	h, err := e.oaepHash()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := pkDecrypt(h, e.Data, pri)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to decrypt with privateKey")
+	}
+	return plaintext, nil
+}
+
+func (e *EncString) oaepHash() (hash.Hash, error) {
+	switch e.Type {
+	case EncRsa2048OaepSha256B64, EncRsa2048OaepSha256HmacSha256B64:
+		return sha256.New(), nil
+	case EncRsa2048OaepSha1B64, EncRsa2048OaepSha1HmacSha256B64:
+		return sha1.New(), nil
+	default:
+		return nil, errors.Errorf("type %d is not an asymmetric encryption", e.Type)
+	}
+}
+
+// NewSymEncString encrypts in type 2 (AES-CBC-256 + HMAC-SHA256)
+func NewSymEncString(key, plain []byte) *EncString {
+	encKey, macKey := deriveEncMacKey(key)
+	iv := RandBytes(16)
+	encrypted := ase256cbcEncrypt(plain, encKey, iv)
+	maced := HMACSha256(macKey, append(append([]byte{}, iv...), encrypted...))
+
+	return &EncString{
+		Type: EncAesCbc256HmacSha256B64,
+		IV:   iv,
+		Data: encrypted,
+		MAC:  maced,
+	}
+}
+
+// NewPKEncString encrypts in type 3 or 4, types with MAC are no longer produced
+func NewPKEncString(encType EncType, data []byte, pub *rsa.PublicKey) (*EncString, error) {
+	if encType != EncRsa2048OaepSha256B64 && encType != EncRsa2048OaepSha1B64 {
+		return nil, errors.Errorf("unsupported type %d to encrypt", encType)
+	}
+	e := &EncString{Type: encType}
+	h, _ := e.oaepHash()
+	e.Data = pkEncrypt(h, data, pub)
+	return e, nil
+}
@@ -0,0 +1,154 @@
+package pkcs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseEncStringSymmetric(t *testing.T) {
+	key := RandBytes(64)
+	plain := []byte("secret value")
+
+	// type 0 has no MAC, only the first half of a 64 bytes key is used
+	iv := RandBytes(16)
+	type0 := Base64Encode(iv) + "|" + Base64Encode(ase256cbcEncrypt(plain, key[:32], iv))
+	type2 := NewSymEncString(key, plain).String()
+
+	// type 1 takes a 32 bytes key, half to encrypt and half to MAC
+	key1 := key[:32]
+	iv1 := RandBytes(16)
+	data1 := ase256cbcEncrypt(plain, key1[:16], iv1)
+	mac1 := HMACSha256(key1[16:], append(append([]byte{}, iv1...), data1...))
+	type1 := Base64Encode(iv1) + "|" + Base64Encode(data1) + "|" + Base64Encode(mac1)
+
+	tests := []struct {
+		name     string
+		s        string
+		key      []byte
+		wantType EncType
+	}{
+		{"type 0", "0." + type0, key, EncAesCbc256B64},
+		{"type 1", "1." + type1, key1, EncAesCbc128HmacSha256B64},
+		{"type 2", type2, key, EncAesCbc256HmacSha256B64},
+		{"headerless with MAC", type1, key1, EncAesCbc128HmacSha256B64},
+		{"headerless without MAC", type0, key, EncAesCbc256B64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseEncString(tt.s)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if e.Type != tt.wantType {
+				t.Fatalf("type = %d, want %d", e.Type, tt.wantType)
+			}
+			got, err := e.Decrypt(tt.key)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("plain = %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestParseEncStringAsymmetric(t *testing.T) {
+	pubBytes, priBytes := GenRSAKeyPair()
+	pub, err := PublicKeyInfo(pubBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pri, err := PrivateKeyInfo(priBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("org key")
+
+	type4, err := NewPKEncString(EncRsa2048OaepSha1B64, plain, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MAC of type 6 is not verified, any bytes work
+	type6 := "6." + Base64Encode(type4.Data) + "|" + Base64Encode(RandBytes(32))
+
+	tests := []struct {
+		name     string
+		s        string
+		wantType EncType
+	}{
+		{"type 4", type4.String(), EncRsa2048OaepSha1B64},
+		{"type 6", type6, EncRsa2048OaepSha1HmacSha256B64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseEncString(tt.s)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if e.Type != tt.wantType {
+				t.Fatalf("type = %d, want %d", e.Type, tt.wantType)
+			}
+			if _, err := e.Decrypt(RandBytes(64)); err == nil {
+				t.Fatal("symmetric decrypt of RSA type must fail")
+			}
+			got, err := e.DecryptPK(pri)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("plain = %q, want %q", got, plain)
+			}
+		})
+	}
+}
+
+func TestParseEncStringInvalid(t *testing.T) {
+	b64 := Base64Encode(RandBytes(16))
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{"bad header", "x." + b64 + "|" + b64 + "|" + b64},
+		{"unknown type", "9." + b64},
+		{"missing MAC", "2." + b64 + "|" + b64},
+		{"bad base64", "2." + b64 + "|!!|" + b64},
+		{"short IV", "2." + Base64Encode(RandBytes(8)) + "|" + b64 + "|" + b64},
+		{"empty data", "4."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseEncString(tt.s); err == nil {
+				t.Fatalf("parse %q: want error", tt.s)
+			}
+		})
+	}
+}
+
+func TestEncStringMACFailure(t *testing.T) {
+	key := RandBytes(64)
+	e := NewSymEncString(key, []byte("secret value"))
+
+	tests := []struct {
+		name   string
+		key    []byte
+		mutate func(e *EncString)
+	}{
+		{"wrong key", RandBytes(64), func(e *EncString) {}},
+		{"tampered data", key, func(e *EncString) { e.Data[0] ^= 0xff }},
+		{"tampered IV", key, func(e *EncString) { e.IV[0] ^= 0xff }},
+		{"truncated MAC", key, func(e *EncString) { e.MAC = e.MAC[:16] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseEncString(e.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.mutate(parsed)
+			if _, err := parsed.Decrypt(tt.key); err == nil {
+				t.Fatal("want MAC error")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package pkcs
+
+import (
+	"math"
+	"strings"
+)
+
+// commonPasswords are common passwords and words, the most common first.
+// It is a short list to catch the worst choices, not a full dictionary.
+var commonPasswords = strings.Fields(`
+	password 123456 qwerty admin welcome letmein monkey dragon iloveyou
+	login abc123 master sunshine princess football baseball shadow superman
+	trustno1 secret access hello freedom whatever passw0rd starwars computer
+	michael jordan hunter ninja mustang summer winter spring autumn changeme
+	default root test guest user vault bitwarden company office love
+`)
+
+// keyboardRows are rows of a US keyboard, runs along a row are guessed
+// early by crackers
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// leetSubs maps common substitutions back to letters
+var leetSubs = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't',
+	'@': 'a', '$': 's', '!': 'i',
+}
+
+const (
+	minSequenceLen = 3
+	minRepeatLen   = 3
+	minKeyboardLen = 4
+)
+
+// PasswordEntropy estimates bits of entropy of human chosen passwords in
+// the way of zxcvbn. The password is split into common words, keyboard
+// runs, sequences like abc or 321, repeats and random characters, and the
+// split guessed with the fewest bits is taken. It is never more than the
+// bound by length and size of character classes.
+func PasswordEntropy(pw string) float64 {
+	rs := []rune(pw)
+	if len(rs) == 0 {
+		return 0
+	}
+	charBits := math.Log2(float64(charsetSize(rs)))
+
+	// best[j] is the fewest bits to guess rs[:j], it is final once all
+	// positions before j are visited
+	best := make([]float64, len(rs)+1)
+	for j := 1; j <= len(rs); j++ {
+		best[j] = math.Inf(1)
+	}
+	for i := 0; i < len(rs); i++ {
+		best[i+1] = math.Min(best[i+1], best[i]+charBits)
+		for _, m := range patternMatches(rs, i) {
+			best[m.end] = math.Min(best[m.end], best[i]+m.bits)
+		}
+	}
+	return best[len(rs)]
+}
+
+// patternMatch covers runes from the start position to end
+type patternMatch struct {
+	end  int
+	bits float64
+}
+
+func patternMatches(rs []rune, i int) []patternMatch {
+	matches := []patternMatch{}
+	matches = append(matches, dictionaryMatches(rs, i)...)
+	matches = append(matches, keyboardMatches(rs, i)...)
+	if m, ok := sequenceMatch(rs, i); ok {
+		matches = append(matches, m)
+	}
+	matches = append(matches, repeatMatches(rs, i)...)
+	return matches
+}
+
+// dictionaryMatches finds common words at i, in any case and with leet
+// substitutions, each costs a bit more to guess
+func dictionaryMatches(rs []rune, i int) []patternMatch {
+	matches := []patternMatch{}
+	for rank, word := range commonPasswords {
+		w := []rune(word)
+		if i+len(w) > len(rs) {
+			continue
+		}
+		upper, leet, ok := false, false, true
+		for k, want := range w {
+			r := rs[i+k]
+			lr := []rune(strings.ToLower(string(r)))[0]
+			upper = upper || lr != r
+			if lr != want {
+				sub, isSub := leetSubs[lr]
+				if !isSub || sub != want {
+					ok = false
+					break
+				}
+				leet = true
+			}
+		}
+		if !ok {
+			continue
+		}
+		bits := math.Log2(float64(rank + 1))
+		if upper {
+			bits++
+		}
+		if leet {
+			bits++
+		}
+		matches = append(matches, patternMatch{end: i + len(w), bits: bits})
+	}
+	return matches
+}
+
+// keyboardMatches finds runs along a keyboard row at i, either direction
+func keyboardMatches(rs []rune, i int) []patternMatch {
+	keys := 0
+	for _, row := range keyboardRows {
+		keys += len(row)
+	}
+
+	matches := []patternMatch{}
+	lower := []rune(strings.ToLower(string(rs[i:])))
+	for _, row := range keyboardRows {
+		for _, reversed := range []bool{false, true} {
+			r := []rune(row)
+			if reversed {
+				r = reverseRunes(r)
+			}
+			n := 0
+			for start := 0; start < len(r); start++ {
+				k := 0
+				for k < len(lower) && start+k < len(r) && lower[k] == r[start+k] {
+					k++
+				}
+				n = max(n, k)
+			}
+			if n < minKeyboardLen {
+				continue
+			}
+			bits := math.Log2(float64(keys)) + math.Log2(float64(n))
+			if reversed {
+				bits++
+			}
+			matches = append(matches, patternMatch{end: i + n, bits: bits})
+		}
+	}
+	return matches
+}
+
+// sequenceMatch finds the longest run at i with a step of one, like abc,
+// 789 or ZYX
+func sequenceMatch(rs []rune, i int) (patternMatch, bool) {
+	if i+1 >= len(rs) {
+		return patternMatch{}, false
+	}
+	step := rs[i+1] - rs[i]
+	if step != 1 && step != -1 {
+		return patternMatch{}, false
+	}
+	n := 2
+	for i+n < len(rs) && rs[i+n]-rs[i+n-1] == step && charClassSize(rs[i+n]) == charClassSize(rs[i]) {
+		n++
+	}
+	if n < minSequenceLen {
+		return patternMatch{}, false
+	}
+	bits := math.Log2(float64(charClassSize(rs[i]))) + math.Log2(float64(n))
+	if step < 0 {
+		bits++
+	}
+	return patternMatch{end: i + n, bits: bits}, true
+}
+
+// repeatMatches finds a unit repeated at i, like aaa or abcabc, it costs
+// the unit and the number of repeats
+func repeatMatches(rs []rune, i int) []patternMatch {
+	matches := []patternMatch{}
+	for unit := 1; i+2*unit <= len(rs); unit++ {
+		count := 1
+		for i+(count+1)*unit <= len(rs) && runesEqual(rs[i:i+unit], rs[i+count*unit:i+(count+1)*unit]) {
+			count++
+		}
+		if count < 2 || count*unit < minRepeatLen {
+			continue
+		}
+		bits := PasswordEntropy(string(rs[i:i+unit])) + math.Log2(float64(count))
+		matches = append(matches, patternMatch{end: i + count*unit, bits: bits})
+	}
+	return matches
+}
+
+// charsetSize is the size of character classes used
+func charsetSize(rs []rune) int {
+	used := map[int]bool{}
+	for _, r := range rs {
+		used[charClass(r)] = true
+	}
+	size := 0
+	for class := range used {
+		size += charClassSizes[class]
+	}
+	return size
+}
+
+// lower, upper, digit, printable symbol and others
+var charClassSizes = []int{26, 26, 10, 33, 100}
+
+func charClass(r rune) int {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return 0
+	case r >= 'A' && r <= 'Z':
+		return 1
+	case r >= '0' && r <= '9':
+		return 2
+	case r >= ' ' && r < 0x7f:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func charClassSize(r rune) int {
+	return charClassSizes[charClass(r)]
+}
+
+func runesEqual(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func reverseRunes(rs []rune) []rune {
+	out := make([]rune, len(rs))
+	for i, r := range rs {
+		out[len(rs)-1-i] = r
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package pkcs
+
+import (
+	"math"
+	"testing"
+)
+
+// naiveEntropy is the bound by length and size of character classes
+func naiveEntropy(pw string) float64 {
+	rs := []rune(pw)
+	return float64(len(rs)) * math.Log2(float64(charsetSize(rs)))
+}
+
+func TestPasswordEntropyPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		pw      string
+		maxBits float64
+	}{
+		{"common password", "password", 5},
+		{"capitalized with suffix", "Password1!", 20},
+		{"leet", "p@ssw0rd", 5},
+		{"repeated char", "aaaaaaaaaaaa", 10},
+		{"repeated unit", "abcabcabcabc", 10},
+		{"sequence", "abcdefghijkl", 10},
+		{"descending digits", "987654321", 10},
+		{"keyboard row", "qwertyuiop", 10},
+		{"reversed keyboard row", "lkjhgfdsa", 10},
+		{"word and year", "Summer2024!", 45},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PasswordEntropy(tt.pw)
+			if got > tt.maxBits {
+				t.Fatalf("entropy of %q = %.1f, want at most %.1f", tt.pw, got, tt.maxBits)
+			}
+			if naive := naiveEntropy(tt.pw); got >= naive {
+				t.Fatalf("entropy of %q = %.1f, want less than naive %.1f", tt.pw, got, naive)
+			}
+		})
+	}
+}
+
+func TestPasswordEntropyRandom(t *testing.T) {
+	tests := []struct {
+		name    string
+		pw      string
+		minBits float64
+	}{
+		{"empty", "", 0},
+		{"mixed", "xK#9vLq!2mZp", 70},
+		{"long lower", "correcthorsebatterystaple", 100},
+		{"generated", GeneratePassword(20), 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PasswordEntropy(tt.pw)
+			if got < tt.minBits {
+				t.Fatalf("entropy of %q = %.1f, want at least %.1f", tt.pw, got, tt.minBits)
+			}
+			// never more than the bound by character classes
+			if naive := naiveEntropy(tt.pw); got > naive+1e-9 {
+				t.Fatalf("entropy of %q = %.1f, more than naive %.1f", tt.pw, got, naive)
+			}
+		})
+	}
+}
+
+func TestPasswordEntropyMonotonic(t *testing.T) {
+	// appending a random part never makes a password weaker
+	base := "Summer2024!"
+	if PasswordEntropy(base+"xK#9") <= PasswordEntropy(base) {
+		t.Fatal("longer password is not stronger")
+	}
+}
@@ -0,0 +1,127 @@
+package pkcs
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// KdfType follows users.client_kdf_type of Vaultwarden
+type KdfType int32
+
+const (
+	KdfPBKDF2   KdfType = 0
+	KdfArgon2id KdfType = 1
+)
+
+const (
+	DefaultArgon2Iterations  = 3
+	DefaultArgon2Memory      = 64 // MiB
+	DefaultArgon2Parallelism = 4
+)
+
+// KdfParams describes how a master key is derived from the master password
+type KdfParams struct {
+	Type        KdfType
+	Iterations  int
+	Memory      int // MiB, argon2id only
+	Parallelism int // argon2id only
+}
+
+func DefaultKdfParams(t KdfType) KdfParams {
+	if t == KdfArgon2id {
+		return KdfParams{
+			Type:        KdfArgon2id,
+			Iterations:  DefaultArgon2Iterations,
+			Memory:      DefaultArgon2Memory,
+			Parallelism: DefaultArgon2Parallelism,
+		}
+	}
+	return KdfParams{
+		Type:       KdfPBKDF2,
+		Iterations: DefaultKdfIterations,
+	}
+}
+
+// StrongerThan reports whether p costs more work than o.
+// Switching from PBKDF2 to Argon2id is always considered stronger.
+func (p KdfParams) StrongerThan(o KdfParams) bool {
+	if p.Type != o.Type {
+		return p.Type == KdfArgon2id
+	}
+	if p.Iterations < o.Iterations {
+		return false
+	}
+	if p.Type == KdfArgon2id {
+		if p.Memory < o.Memory || p.Parallelism < o.Parallelism {
+			return false
+		}
+		return p != o
+	}
+	return p.Iterations > o.Iterations
+}
+
+func (p KdfParams) String() string {
+	switch p.Type {
+	case KdfPBKDF2:
+		return fmt.Sprintf("pbkdf2(iterations=%d)", p.Iterations)
+	case KdfArgon2id:
+		return fmt.Sprintf(
+			"argon2id(iterations=%d, memory=%dMiB, parallelism=%d)",
+			p.Iterations, p.Memory, p.Parallelism,
+		)
+	default:
+		return fmt.Sprintf("unknown(%d)", p.Type)
+	}
+}
+
+// Validate checks parameters against the limits accepted by Bitwarden clients
+func (p KdfParams) Validate() error {
+	switch p.Type {
+	case KdfPBKDF2:
+		if p.Iterations < 5_000 || p.Iterations > 2_000_000 {
+			return errors.Errorf("pbkdf2 iterations must be in [5000, 2000000], got %d", p.Iterations)
+		}
+	case KdfArgon2id:
+		if p.Iterations < 2 || p.Iterations > 10 {
+			return errors.Errorf("argon2id iterations must be in [2, 10], got %d", p.Iterations)
+		}
+		if p.Memory < 15 || p.Memory > 1024 {
+			return errors.Errorf("argon2id memory must be in [15, 1024] MiB, got %d", p.Memory)
+		}
+		if p.Parallelism < 1 || p.Parallelism > 16 {
+			return errors.Errorf("argon2id parallelism must be in [1, 16], got %d", p.Parallelism)
+		}
+	default:
+		return errors.Errorf("unsupported kdf type %d", p.Type)
+	}
+	return nil
+}
+
+func DeriveMasterKey(email, password string, kdf KdfParams) ([]byte, error) {
+	if err := kdf.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch kdf.Type {
+	case KdfArgon2id:
+		// same as Bitwarden clients, salt is the sha256 of email
+		salt := sha256.Sum256([]byte(email))
+		return argon2.IDKey(
+			[]byte(password),
+			salt[:],
+			uint32(kdf.Iterations),
+			uint32(kdf.Memory*1024),
+			uint8(kdf.Parallelism),
+			32,
+		), nil
+	default:
+		return pbkdf2SHA256(
+			[]byte(password),
+			[]byte(email),
+			kdf.Iterations,
+		), nil
+	}
+}
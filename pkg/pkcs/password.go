@@ -0,0 +1,54 @@
+package pkcs
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// characters of generated passwords, similar ones like 0/O and 1/l are left out
+var passwordClasses = []string{
+	"abcdefghijkmnopqrstuvwxyz",
+	"ABCDEFGHJKLMNPQRSTUVWXYZ",
+	"23456789",
+	"!@#$%^&*-_=+?",
+}
+
+// GeneratePassword returns a random password with at least one
+// character of each class, length is at least the number of classes.
+func GeneratePassword(length int) string {
+	if length < len(passwordClasses) {
+		length = len(passwordClasses)
+	}
+
+	all := ""
+	for _, c := range passwordClasses {
+		all += c
+	}
+
+	pw := make([]byte, length)
+	for i := range pw {
+		if i < len(passwordClasses) {
+			pw[i] = randChar(passwordClasses[i])
+		} else {
+			pw[i] = randChar(all)
+		}
+	}
+	// shuffle, or the leading characters are predictable in class
+	for i := len(pw) - 1; i > 0; i-- {
+		j := randInt(i + 1)
+		pw[i], pw[j] = pw[j], pw[i]
+	}
+	return string(pw)
+}
+
+func randChar(chars string) byte {
+	return chars[randInt(len(chars))]
+}
+
+func randInt(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(v.Int64())
+}
@@ -7,34 +7,22 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
-	"fmt"
-	"regexp"
+	"hash"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
-	ITERATIONS = 600_000
+	// default iterations of client side PBKDF2
+	DefaultKdfIterations = 600_000
+	// default iterations of server side password hashing
+	DefaultPasswordIterations = 600_000
 )
 
-var (
-	rxBWEnc = regexp.MustCompile("^2\\.([^|]+)\\|([^|]+)\\|(.+)$")
-	rxBWPk  = regexp.MustCompile("^4\\.([^|]+)$")
-)
-
-func DeriveMasterKey(email, password string) []byte {
-	return pbkdf2SHA256(
-		[]byte(password),
-		[]byte(email),
-		ITERATIONS,
-	)
-}
-
 func DerivePasswordHash(masterKey []byte, masterPasswod string) string {
 	return Base64Encode(pbkdf2SHA256(
 		masterKey,
@@ -43,11 +31,11 @@ func DerivePasswordHash(masterKey []byte, masterPasswod string) string {
 	))
 }
 
-func HashPasswordHash(passwordHash string, salt []byte) []byte {
+func HashPasswordHash(passwordHash string, salt []byte, iterations int) []byte {
 	return pbkdf2SHA256(
 		[]byte(passwordHash),
 		salt,
-		ITERATIONS,
+		iterations,
 	)
 }
 
@@ -97,52 +85,20 @@ func PrivateKeyInfo(key []byte) (*rsa.PrivateKey, error) {
 }
 
 func IsBWSymFormat(cipher string) bool {
-	return rxBWEnc.MatchString(cipher)
+	e, err := ParseEncString(cipher)
+	return err == nil && e.IsSymmetric()
 }
 
 func BWSymEncrypt(key, plain []byte) string {
-	encKey, macKey := deriveEncMacKey(key)
-	iv := RandBytes(16)
-	encrypted := ase256cbcEncrypt(plain, encKey, iv)
-	maced := HMACSha256(macKey, append(iv, encrypted...))
-
-	return fmt.Sprintf(
-		"2.%s|%s|%s",
-		Base64Encode(iv),
-		Base64Encode(encrypted),
-		Base64Encode(maced),
-	)
+	return NewSymEncString(key, plain).String()
 }
 
 func BWSymDecrypt(key []byte, cipher string) ([]byte, error) {
-	matched := rxBWEnc.FindAllStringSubmatch(cipher, -1)
-	if len(matched) == 0 {
-		return nil, errors.New(("invalid Bitwarden key format"))
-	}
-	// decode base64
-	b64Decoded, err := Base64DecodeMany(matched[0][1:]...)
+	e, err := ParseEncString(cipher)
 	if err != nil {
-		return nil, errors.Wrap(err, "fail to decode base64")
-	}
-	iv, encData, mac := b64Decoded[0], b64Decoded[1], b64Decoded[2]
-
-	encKey, macKey := deriveEncMacKey(key)
-	macData := iv
-	macData = append(macData, encData...)
-	expectedMac := HMACSha256(macKey, macData)
-
-	if len(mac) != len(expectedMac) {
-		return nil, errors.New("MAC length mismatch")
+		return nil, errors.Wrap(err, "invalid Bitwarden key format")
 	}
-	if !bytes.Equal(mac, expectedMac) {
-		return nil, errors.New("MAC validation failed - wrong masterKey or tampered data")
-	}
-
-	plaintext, err := aes256cbcDecrypt(encData, encKey, iv)
-	if err != nil {
-		return nil, errors.Wrap(err, "fail to decrypt")
-	}
-	return plaintext, nil
+	return e.Decrypt(key)
 }
 
 func BWSymDecryptMany(key []byte, ciphers ...string) ([][]byte, error) {
@@ -169,25 +125,16 @@ func deriveEncMacKey(key []byte) (encKey []byte, macKey []byte) {
 }
 
 func BWPKEncrypt(data []byte, pub *rsa.PublicKey) string {
-	encrypted := pkEncrypt(data, pub)
-	return fmt.Sprintf("4.%s", Base64Encode(encrypted))
+	e, _ := NewPKEncString(EncRsa2048OaepSha1B64, data, pub)
+	return e.String()
 }
 
 func BWPKDecrypt(cipher string, pri *rsa.PrivateKey) ([]byte, error) {
-	matched := rxBWPk.FindAllStringSubmatch(cipher, -1)
-	if len(matched) == 0 {
-		return nil, errors.New(("invalid Bitwarden key format"))
-	}
-
-	encData, err := Base64Decode(matched[0][1])
+	e, err := ParseEncString(cipher)
 	if err != nil {
-		return nil, errors.Wrap(err, "fail to parse encrypted data")
+		return nil, errors.Wrap(err, "invalid Bitwarden key format")
 	}
-	plaintext, err := pkDecrypt(encData, pri)
-	if err != nil {
-		return nil, errors.Wrap(err, "fail to decrypt with privateKey")
-	}
-	return plaintext, nil
+	return e.DecryptPK(pri)
 }
 
 func Base64Encode(data []byte) string {
@@ -249,16 +196,16 @@ func hkdfExpand(prk []byte, info string, length int) []byte {
 	return result[:length]
 }
 
-func pkEncrypt(data []byte, pub *rsa.PublicKey) []byte {
-	ciphertext, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, data, []byte(""))
+func pkEncrypt(h hash.Hash, data []byte, pub *rsa.PublicKey) []byte {
+	ciphertext, err := rsa.EncryptOAEP(h, rand.Reader, pub, data, []byte(""))
 	if err != nil {
 		panic(err)
 	}
 	return ciphertext
 }
 
-func pkDecrypt(data []byte, pri *rsa.PrivateKey) ([]byte, error) {
-	plaintext, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, pri, data, []byte(""))
+func pkDecrypt(h hash.Hash, data []byte, pri *rsa.PrivateKey) ([]byte, error) {
+	plaintext, err := rsa.DecryptOAEP(h, rand.Reader, pri, data, []byte(""))
 	if err != nil {
 		return nil, errors.Wrap(err, "fail to decrypt by public key")
 	}
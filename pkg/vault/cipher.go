@@ -0,0 +1,354 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+	"github.com/pkg/errors"
+)
+
+// Cipher is a decrypted vault item
+type Cipher struct {
+	UUID            string            `json:"id"`
+	OrgUUID         string            `json:"organizationId,omitempty"`
+	UserUUID        string            `json:"userId,omitempty"`
+	Type            CipherType        `json:"type"`
+	Name            string            `json:"name"`
+	Notes           string            `json:"notes,omitempty"`
+	Login           *Login            `json:"login,omitempty"`
+	SecureNote      *SecureNote       `json:"secureNote,omitempty"`
+	Card            *Card             `json:"card,omitempty"`
+	Identity        *Identity         `json:"identity,omitempty"`
+	SSHKey          *SSHKey           `json:"sshKey,omitempty"`
+	Fields          []Field           `json:"fields,omitempty"`
+	PasswordHistory []PasswordHistory `json:"passwordHistory,omitempty"`
+	Reprompt        int32             `json:"reprompt"`
+	CreatedAt       time.Time         `json:"creationDate"`
+	UpdatedAt       time.Time         `json:"revisionDate"`
+	DeletedAt       *time.Time        `json:"deletedDate,omitempty"`
+
+	// encrypted item level key, if any
+	itemKey string
+	// properties of data not modeled, e.g. fido2Credentials, kept as is
+	extra map[string]json.RawMessage
+}
+
+// legacyDataKeys are item level properties older Vaultwarden also wrote
+// into data, e.g. "Name", superseded by their own columns
+var legacyDataKeys = []string{"name", "notes", "fields", "passwordHistory"}
+
+// Decrypt decrypts a row of ciphers with the org sym key for org items,
+// or the user sym key for personal items.
+func Decrypt(c *model.Cipher, key []byte) (*Cipher, error) {
+	if c.Key != nil && *c.Key != "" {
+		// item level key, protected by org or user key
+		itemKey, err := pkcs.BWSymDecrypt(key, *c.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to decrypt key of cipher %s", c.UUID)
+		}
+		key = itemKey
+	}
+
+	v := &Cipher{
+		UUID:      c.UUID,
+		Type:      CipherType(c.Atype),
+		Name:      c.Name,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+		DeletedAt: c.DeletedAt,
+	}
+	if c.OrganizationUUID != nil {
+		v.OrgUUID = *c.OrganizationUUID
+	}
+	if c.UserUUID != nil {
+		v.UserUUID = *c.UserUUID
+	}
+	if c.Notes != nil {
+		v.Notes = *c.Notes
+	}
+	if c.Reprompt != nil {
+		v.Reprompt = *c.Reprompt
+	}
+	if c.Key != nil {
+		v.itemKey = *c.Key
+	}
+
+	if err := unmarshalColumn(c.Fields, &v.Fields); err != nil {
+		return nil, errors.Wrapf(err, "fail to parse fields of cipher %s", c.UUID)
+	}
+	if err := unmarshalColumn(c.PasswordHistory, &v.PasswordHistory); err != nil {
+		return nil, errors.Wrapf(err, "fail to parse password history of cipher %s", c.UUID)
+	}
+	if err := v.unmarshalData(c.Data); err != nil {
+		return nil, errors.Wrapf(err, "fail to parse data of cipher %s", c.UUID)
+	}
+
+	if err := v.walk(decrypter(key)); err != nil {
+		return nil, errors.Wrapf(err, "fail to decrypt cipher %s", c.UUID)
+	}
+	return v, nil
+}
+
+// Username returns username of login items, or empty string
+func (c *Cipher) Username() string {
+	if c.Login == nil {
+		return ""
+	}
+	return c.Login.Username
+}
+
+// Password returns password of login items, or empty string
+func (c *Cipher) Password() string {
+	if c.Login == nil {
+		return ""
+	}
+	return c.Login.Password
+}
+
+func (c *Cipher) unmarshalData(data string) error {
+	var target interface{}
+	switch c.Type {
+	case TypeLogin:
+		c.Login = &Login{}
+		target = c.Login
+	case TypeSecureNote:
+		c.SecureNote = &SecureNote{}
+		target = c.SecureNote
+	case TypeCard:
+		c.Card = &Card{}
+		target = c.Card
+	case TypeIdentity:
+		c.Identity = &Identity{}
+		target = c.Identity
+	case TypeSSHKey:
+		c.SSHKey = &SSHKey{}
+		target = c.SSHKey
+	default:
+		return errors.Errorf("unknown cipher type %d", c.Type)
+	}
+	if data == "" {
+		return nil
+	}
+	// keys are matched case-insensitively, so PascalCase data written
+	// by older Vaultwarden is also accepted
+	if err := json.Unmarshal([]byte(data), target); err != nil {
+		return err
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return err
+	}
+	known := jsonKeys(target)
+	for k, v := range raw {
+		if !containsFold(known, k) {
+			if c.extra == nil {
+				c.extra = map[string]json.RawMessage{}
+			}
+			c.extra[k] = v
+		}
+	}
+	return nil
+}
+
+func (c *Cipher) marshalData() (string, error) {
+	var source interface{}
+	switch {
+	case c.Login != nil:
+		source = c.Login
+	case c.SecureNote != nil:
+		source = c.SecureNote
+	case c.Card != nil:
+		source = c.Card
+	case c.Identity != nil:
+		source = c.Identity
+	case c.SSHKey != nil:
+		source = c.SSHKey
+	default:
+		return "", errors.Errorf("no data of cipher type %d", c.Type)
+	}
+
+	bs, err := json.Marshal(source)
+	if err != nil || len(c.extra) == 0 {
+		return string(bs), err
+	}
+
+	merged := map[string]json.RawMessage{}
+	if err := json.Unmarshal(bs, &merged); err != nil {
+		return "", err
+	}
+	for k, v := range c.extra {
+		// stale copies of columns are dropped rather than written back
+		if containsFold(legacyDataKeys, k) {
+			continue
+		}
+		merged[k] = v
+	}
+	bs, err = json.Marshal(merged)
+	return string(bs), err
+}
+
+func (c *Cipher) walk(fn cryptFunc) error {
+	if err := walkStrings(fn, &c.Name, &c.Notes); err != nil {
+		return err
+	}
+	for i := range c.Fields {
+		if err := walkStrings(fn, &c.Fields[i].Name, &c.Fields[i].Value); err != nil {
+			return err
+		}
+	}
+	for i := range c.PasswordHistory {
+		if err := fn(&c.PasswordHistory[i].Password); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case c.Login != nil:
+		return c.Login.walk(fn)
+	case c.Card != nil:
+		return c.Card.walk(fn)
+	case c.Identity != nil:
+		return c.Identity.walk(fn)
+	case c.SSHKey != nil:
+		return c.SSHKey.walk(fn)
+	}
+	return nil
+}
+
+// Encrypt encrypts a decrypted item into a row of ciphers with the key
+// used by Decrypt. UUID, owner and timestamps are left to the caller.
+func Encrypt(v *Cipher, key []byte) (*model.Cipher, error) {
+	reprompt := v.Reprompt
+	c := &model.Cipher{
+		Atype:    int32(v.Type),
+		Reprompt: &reprompt,
+	}
+	if v.itemKey != "" {
+		itemKey, err := pkcs.BWSymDecrypt(key, v.itemKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to decrypt key of cipher %s", v.UUID)
+		}
+		c.Key, key = &v.itemKey, itemKey
+	}
+
+	// work on a copy to leave the decrypted item untouched
+	cp, err := v.clone()
+	if err != nil {
+		return nil, err
+	}
+	if cp.Login != nil {
+		for i := range cp.Login.Uris {
+			cp.Login.Uris[i].URIChecksum = uriChecksum(cp.Login.Uris[i].URI)
+		}
+	}
+	if err := cp.walk(encrypter(key)); err != nil {
+		return nil, errors.Wrapf(err, "fail to encrypt cipher %s", v.UUID)
+	}
+
+	c.Name = cp.Name
+	if cp.Notes != "" {
+		c.Notes = &cp.Notes
+	}
+	if c.Fields, err = marshalColumn(cp.Fields); err != nil {
+		return nil, err
+	}
+	if c.PasswordHistory, err = marshalColumn(cp.PasswordHistory); err != nil {
+		return nil, err
+	}
+	if c.Data, err = cp.marshalData(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cipher) clone() (*Cipher, error) {
+	bs, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Cipher{}
+	if err := json.Unmarshal(bs, cp); err != nil {
+		return nil, err
+	}
+	cp.itemKey, cp.extra = c.itemKey, c.extra
+	return cp, nil
+}
+
+func marshalColumn[T any](items []T) (*string, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	bs, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	s := string(bs)
+	return &s, nil
+}
+
+func unmarshalColumn(col *string, v interface{}) error {
+	if col == nil || *col == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(*col), v)
+}
+
+func decrypter(key []byte) cryptFunc {
+	return func(s *string) error {
+		if *s == "" {
+			return nil
+		}
+		plain, err := pkcs.BWSymDecrypt(key, *s)
+		if err != nil {
+			return err
+		}
+		*s = string(plain)
+		return nil
+	}
+}
+
+func encrypter(key []byte) cryptFunc {
+	return func(s *string) error {
+		if *s == "" {
+			return nil
+		}
+		*s = pkcs.BWSymEncrypt(key, []byte(*s))
+		return nil
+	}
+}
+
+func uriChecksum(uri string) string {
+	if uri == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(uri))
+	return pkcs.Base64Encode(sum[:])
+}
+
+// jsonKeys returns json property names of a struct pointer
+func jsonKeys(v interface{}) []string {
+	keys := []string{}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package vault
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/imtaco/vwmgr/pkg/model"
+	"github.com/imtaco/vwmgr/pkg/pkcs"
+)
+
+func enc(key []byte, s string) string {
+	return pkcs.BWSymEncrypt(key, []byte(s))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// newRow builds an org item row, data is a JSON of already encrypted values
+func newRow(key []byte, atype CipherType, data string) *model.Cipher {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &model.Cipher{
+		UUID:             "c0ffee00-0000-4000-8000-000000000001",
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		OrganizationUUID: ptr("0a000000-0000-4000-8000-000000000001"),
+		Atype:            int32(atype),
+		Name:             enc(key, "item name"),
+		Notes:            ptr(enc(key, "some notes")),
+		Fields:           ptr(`[{"name":"` + enc(key, "pin") + `","value":"` + enc(key, "1234") + `","type":1,"linkedId":null}]`),
+		PasswordHistory:  ptr(`[{"password":"` + enc(key, "old-pass") + `","lastUsedDate":"2024-01-02T03:04:05Z"}]`),
+		Data:             data,
+		Reprompt:         ptr(int32(0)),
+	}
+}
+
+// roundTrip decrypts row, encrypts it back and decrypts again, both
+// decrypted items must be the same
+func roundTrip(t *testing.T, row *model.Cipher, key []byte) (*Cipher, *model.Cipher) {
+	t.Helper()
+	v, err := Decrypt(row, key)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	out, err := Encrypt(v, key)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	out.UUID, out.CreatedAt, out.UpdatedAt = row.UUID, row.CreatedAt, row.UpdatedAt
+	out.OrganizationUUID = row.OrganizationUUID
+
+	again, err := Decrypt(out, key)
+	if err != nil {
+		t.Fatalf("decrypt again: %v", err)
+	}
+	want, _ := json.Marshal(v)
+	got, _ := json.Marshal(again)
+	if string(got) != string(want) {
+		t.Fatalf("round trip\n got %s\nwant %s", got, want)
+	}
+	return v, out
+}
+
+func TestRoundTripLogin(t *testing.T) {
+	key := pkcs.RandBytes(64)
+	data := `{"username":"` + enc(key, "admin") + `","password":"` + enc(key, "s3cret!") + `",` +
+		`"uris":[{"uri":"` + enc(key, "https://example.com") + `","uriChecksum":"` + enc(key, uriChecksum("https://example.com")) + `","match":null}],` +
+		`"fido2Credentials":[{"credentialId":"` + enc(key, "cred") + `"}]}`
+	v, out := roundTrip(t, newRow(key, TypeLogin, data), key)
+
+	if v.Name != "item name" || v.Notes != "some notes" {
+		t.Fatalf("name = %q, notes = %q", v.Name, v.Notes)
+	}
+	if v.Username() != "admin" || v.Password() != "s3cret!" {
+		t.Fatalf("username = %q, password = %q", v.Username(), v.Password())
+	}
+	if len(v.Fields) != 1 || v.Fields[0].Value != "1234" {
+		t.Fatalf("fields = %+v", v.Fields)
+	}
+	if len(v.PasswordHistory) != 1 || v.PasswordHistory[0].Password != "old-pass" {
+		t.Fatalf("password history = %+v", v.PasswordHistory)
+	}
+	// properties not modeled are kept as is
+	if !strings.Contains(out.Data, `"fido2Credentials"`) {
+		t.Fatalf("fido2Credentials dropped: %s", out.Data)
+	}
+}
+
+func TestRoundTripCard(t *testing.T) {
+	key := pkcs.RandBytes(64)
+	data := `{"cardholderName":"` + enc(key, "Test User") + `","brand":"` + enc(key, "Visa") + `",` +
+		`"number":"` + enc(key, "4111111111111111") + `","expMonth":"` + enc(key, "12") + `",` +
+		`"expYear":"` + enc(key, "2030") + `","code":"` + enc(key, "123") + `"}`
+	v, _ := roundTrip(t, newRow(key, TypeCard, data), key)
+
+	if v.Card == nil || v.Card.Number != "4111111111111111" || v.Card.Code != "123" {
+		t.Fatalf("card = %+v", v.Card)
+	}
+	if v.Password() != "" {
+		t.Fatalf("password of card = %q", v.Password())
+	}
+}
+
+func TestRoundTripLegacyData(t *testing.T) {
+	key := pkcs.RandBytes(64)
+	// PascalCase data of older Vaultwarden, with copies of name and notes
+	data := `{"Username":"` + enc(key, "admin") + `","Password":"` + enc(key, "s3cret!") + `",` +
+		`"Uris":[{"Uri":"` + enc(key, "https://example.com") + `","UriChecksum":"` + enc(key, uriChecksum("https://example.com")) + `","Match":null}],` +
+		`"Name":"` + enc(key, "stale name") + `","Notes":"` + enc(key, "stale notes") + `",` +
+		`"Response":null}`
+	v, out := roundTrip(t, newRow(key, TypeLogin, data), key)
+
+	if v.Name != "item name" || v.Username() != "admin" || v.Password() != "s3cret!" {
+		t.Fatalf("name = %q, username = %q, password = %q", v.Name, v.Username(), v.Password())
+	}
+	if len(v.Login.Uris) != 1 || v.Login.Uris[0].URI != "https://example.com" {
+		t.Fatalf("uris = %+v", v.Login.Uris)
+	}
+
+	written := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(out.Data), &written); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Name", "Notes", "Username", "Password", "Uris"} {
+		if _, ok := written[k]; ok {
+			t.Fatalf("legacy key %s written back: %s", k, out.Data)
+		}
+	}
+	for _, k := range []string{"username", "password", "uris", "Response"} {
+		if _, ok := written[k]; !ok {
+			t.Fatalf("key %s missing: %s", k, out.Data)
+		}
+	}
+}
+
+func TestRoundTripItemKey(t *testing.T) {
+	orgKey := pkcs.RandBytes(64)
+	itemKey := pkcs.RandBytes(64)
+	data := `{"username":"` + enc(itemKey, "admin") + `","password":"` + enc(itemKey, "s3cret!") + `"}`
+	row := newRow(itemKey, TypeLogin, data)
+	row.Key = ptr(enc(orgKey, string(itemKey)))
+
+	v, out := roundTrip(t, row, orgKey)
+	if v.Password() != "s3cret!" {
+		t.Fatalf("password = %q", v.Password())
+	}
+	if out.Key == nil || *out.Key != *row.Key {
+		t.Fatalf("item key = %v, want %s", out.Key, *row.Key)
+	}
+	// values are under the item key, not the org key
+	if _, err := pkcs.BWSymDecrypt(orgKey, out.Name); err == nil {
+		t.Fatal("name is decrypted by the org key")
+	}
+	if name, err := pkcs.BWSymDecrypt(itemKey, out.Name); err != nil || string(name) != "item name" {
+		t.Fatalf("name = %q, err = %v", name, err)
+	}
+}
@@ -0,0 +1,142 @@
+package vault
+
+import (
+	"time"
+)
+
+// CipherType follows ciphers.atype of Vaultwarden
+type CipherType int32
+
+const (
+	TypeLogin      CipherType = 1
+	TypeSecureNote CipherType = 2
+	TypeCard       CipherType = 3
+	TypeIdentity   CipherType = 4
+	TypeSSHKey     CipherType = 5
+)
+
+// FieldType of custom fields
+type FieldType int32
+
+const (
+	FieldText    FieldType = 0
+	FieldHidden  FieldType = 1
+	FieldBoolean FieldType = 2
+	FieldLinked  FieldType = 3
+)
+
+// Types below mirror the JSON stored in ciphers.data, fields and
+// password_history columns, so their json tags follow Bitwarden's camelCase.
+// Values of string fields are cipher strings until decrypted.
+
+type Login struct {
+	Username             string     `json:"username,omitempty"`
+	Password             string     `json:"password,omitempty"`
+	PasswordRevisionDate *time.Time `json:"passwordRevisionDate,omitempty"`
+	Totp                 string     `json:"totp,omitempty"`
+	Uris                 []LoginURI `json:"uris,omitempty"`
+	AutofillOnPageLoad   *bool      `json:"autofillOnPageLoad,omitempty"`
+}
+
+type LoginURI struct {
+	URI         string `json:"uri,omitempty"`
+	URIChecksum string `json:"uriChecksum,omitempty"`
+	Match       *int32 `json:"match"`
+}
+
+type SecureNote struct {
+	Type int32 `json:"type"`
+}
+
+type Card struct {
+	CardholderName string `json:"cardholderName,omitempty"`
+	Brand          string `json:"brand,omitempty"`
+	Number         string `json:"number,omitempty"`
+	ExpMonth       string `json:"expMonth,omitempty"`
+	ExpYear        string `json:"expYear,omitempty"`
+	Code           string `json:"code,omitempty"`
+}
+
+type Identity struct {
+	Title          string `json:"title,omitempty"`
+	FirstName      string `json:"firstName,omitempty"`
+	MiddleName     string `json:"middleName,omitempty"`
+	LastName       string `json:"lastName,omitempty"`
+	Address1       string `json:"address1,omitempty"`
+	Address2       string `json:"address2,omitempty"`
+	Address3       string `json:"address3,omitempty"`
+	City           string `json:"city,omitempty"`
+	State          string `json:"state,omitempty"`
+	PostalCode     string `json:"postalCode,omitempty"`
+	Country        string `json:"country,omitempty"`
+	Company        string `json:"company,omitempty"`
+	Email          string `json:"email,omitempty"`
+	Phone          string `json:"phone,omitempty"`
+	SSN            string `json:"ssn,omitempty"`
+	Username       string `json:"username,omitempty"`
+	PassportNumber string `json:"passportNumber,omitempty"`
+	LicenseNumber  string `json:"licenseNumber,omitempty"`
+}
+
+type SSHKey struct {
+	PrivateKey     string `json:"privateKey,omitempty"`
+	PublicKey      string `json:"publicKey,omitempty"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+}
+
+type Field struct {
+	Name     string    `json:"name,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	Type     FieldType `json:"type"`
+	LinkedID *int32    `json:"linkedId"`
+}
+
+type PasswordHistory struct {
+	Password     string    `json:"password"`
+	LastUsedDate time.Time `json:"lastUsedDate"`
+}
+
+// cryptFunc encrypts or decrypts a string in place
+type cryptFunc func(s *string) error
+
+func walkStrings(fn cryptFunc, ss ...*string) error {
+	for _, s := range ss {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Login) walk(fn cryptFunc) error {
+	if err := walkStrings(fn, &l.Username, &l.Password, &l.Totp); err != nil {
+		return err
+	}
+	for i := range l.Uris {
+		if err := walkStrings(fn, &l.Uris[i].URI, &l.Uris[i].URIChecksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Card) walk(fn cryptFunc) error {
+	return walkStrings(fn,
+		&c.CardholderName, &c.Brand, &c.Number,
+		&c.ExpMonth, &c.ExpYear, &c.Code,
+	)
+}
+
+func (i *Identity) walk(fn cryptFunc) error {
+	return walkStrings(fn,
+		&i.Title, &i.FirstName, &i.MiddleName, &i.LastName,
+		&i.Address1, &i.Address2, &i.Address3,
+		&i.City, &i.State, &i.PostalCode, &i.Country,
+		&i.Company, &i.Email, &i.Phone, &i.SSN, &i.Username,
+		&i.PassportNumber, &i.LicenseNumber,
+	)
+}
+
+func (k *SSHKey) walk(fn cryptFunc) error {
+	return walkStrings(fn, &k.PrivateKey, &k.PublicKey, &k.KeyFingerprint)
+}